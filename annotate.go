@@ -0,0 +1,28 @@
+package profile
+
+import (
+	"context"
+	"runtime/trace"
+)
+
+// Region runs fn inside a named region of the execution trace, associated with
+// the trace task in ctx if any. Regions appear in the "User-defined regions"
+// view of go tool trace, correlating application events with the runtime. If
+// the execution trace is not running, fn is called directly.
+func Region(ctx context.Context, name string, fn func()) {
+	if !trace.IsEnabled() {
+		fn()
+		return
+	}
+	trace.WithRegion(ctx, name, fn)
+}
+
+// LogEvent records a message with the given category in the execution trace,
+// associated with the trace task in ctx if any. Has no effect if the execution
+// trace is not running.
+func LogEvent(ctx context.Context, category, message string) {
+	if !trace.IsEnabled() {
+		return
+	}
+	trace.Log(ctx, category, message)
+}
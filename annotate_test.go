@@ -0,0 +1,41 @@
+package profile_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestRegion(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	ctx := context.Background()
+	p := profile.Start(profile.TraceProfile, profile.WithLogger(Logger(t)))
+	profile.Region(ctx, "annotated-region", contend)
+	profile.LogEvent(ctx, "annotated-category", "annotated-message")
+	p.Stop()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "trace.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"annotated-region", "annotated-category", "annotated-message"} {
+		if !bytes.Contains(b, []byte(expect)) {
+			t.Errorf("expected %q in trace", expect)
+		}
+	}
+}
+
+func TestRegionNotTracing(t *testing.T) {
+	called := false
+	profile.Region(context.Background(), "region", func() { called = true })
+	if !called {
+		t.Fatal("expected region function to be called")
+	}
+	profile.LogEvent(context.Background(), "category", "message")
+}
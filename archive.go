@@ -0,0 +1,79 @@
+package profile
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WithArchive configures profiles to be bundled into a single zip archive at
+// path, rather than written to separate files. Each profile is written as an
+// entry in the archive named by its output filename. Since zip entries must be
+// written sequentially, profiles are buffered in memory and the archive is
+// written when profiling is stopped.
+func WithArchive(path string) func(*Profile) {
+	return func(p *Profile) { p.archivepath = path }
+}
+
+// archive is a Filesystem that buffers files in memory for writing to a zip
+// archive.
+type archive struct {
+	mu      sync.Mutex
+	entries []*archiveentry
+}
+
+type archiveentry struct {
+	name string
+	buf  bytes.Buffer
+}
+
+func (e *archiveentry) Write(p []byte) (int, error) { return e.buf.Write(p) }
+func (e *archiveentry) Close() error                { return nil }
+
+// Create adds a new entry to the archive.
+func (a *archive) Create(name string) (io.WriteCloser, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := &archiveentry{
+		name: strings.TrimLeft(filepath.ToSlash(filepath.Clean(name)), "/"),
+	}
+	a.entries = append(a.entries, e)
+	return e, nil
+}
+
+// write writes the zip archive to w.
+func (a *archive) write(w io.Writer) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	z := zip.NewWriter(w)
+	for _, e := range a.entries {
+		f, err := z.Create(e.name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(e.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return z.Close()
+}
+
+// writearchive writes the archive to the underlying filesystem.
+func (p *Profile) writearchive() (err error) {
+	f, err := p.fs.Create(p.path(p.archivepath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errc := f.Close(); err == nil && errc != nil {
+			err = errc
+		}
+	}()
+
+	return p.archive.write(f)
+}
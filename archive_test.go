@@ -0,0 +1,69 @@
+package profile_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithArchive(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	profile.Start(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.TraceProfile,
+		profile.WithArchive("profiles.zip"),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	// Only the archive should be written.
+	AssertDirContains(t, dir, []string{"profiles.zip"})
+
+	// Open the archive.
+	z, err := zip.OpenReader(filepath.Join(dir, "profiles.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+
+	// Verify each entry.
+	var names []string
+	for _, f := range z.File {
+		names = append(names, f.Name)
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(b) == 0 {
+			t.Errorf("entry %s is empty", f.Name)
+		}
+
+		// Profiles in protobuf format are gzipped.
+		if filepath.Ext(f.Name) == ".pprof" && !bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+			t.Errorf("entry %s is not a gzipped profile", f.Name)
+		}
+	}
+
+	sort.Strings(names)
+	expect := []string{"cpu.pprof", "mem.pprof", "trace.out"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Fatalf("got entries %v; expect %v", names, expect)
+	}
+}
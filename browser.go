@@ -0,0 +1,51 @@
+package profile
+
+import (
+	"os"
+	"os/exec"
+)
+
+// WithOpenBrowser configures the named profile to be opened in a web browser
+// after profiling stops. This runs "go tool pprof -http" on the output file, or
+// "go tool trace" for the execution trace, in the background. It requires the
+// go tool to be installed, and is intended for local development only.
+func WithOpenBrowser(name string) func(*Profile) {
+	return func(p *Profile) { p.openbrowser = name }
+}
+
+// startcommand starts a command in the background, without waiting for it to
+// complete.
+func startcommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// browse opens the configured profile in a web browser.
+func (p *Profile) browse() {
+	m := p.method(p.openbrowser)
+	if m == nil || m.Filename() == "" {
+		p.log("%s profile: not enabled: cannot open in browser", p.openbrowser)
+		return
+	}
+
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		p.log("%s profile: cannot open in browser: %v", m.Name(), err)
+		return
+	}
+
+	filename := p.methodpath(m, m.Filename())
+	args := []string{"tool", "pprof", "-http=:0", filename}
+	if _, ok := m.(*tracer); ok {
+		args = []string{"tool", "trace", filename}
+	}
+
+	if err := p.run(gobin, args...); err != nil {
+		p.log("%s profile: error opening in browser: %v", m.Name(), err)
+	}
+}
@@ -0,0 +1,57 @@
+package profile_test
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithOpenBrowser(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go tool not found")
+	}
+
+	cases := []struct {
+		Name    string
+		Options []func(*profile.Profile)
+		Expect  []string
+	}{
+		{
+			Name:    "cpu",
+			Options: []func(*profile.Profile){profile.CPUProfile, profile.MemProfile, profile.WithOpenBrowser("cpu")},
+			Expect:  []string{"tool", "pprof", "-http=:0", "cpu.pprof"},
+		},
+		{
+			Name:    "trace",
+			Options: []func(*profile.Profile){profile.TraceProfile, profile.WithOpenBrowser("trace")},
+			Expect:  []string{"tool", "trace", "trace.out"},
+		},
+	}
+	for _, c := range cases {
+		c := c // scopelint
+		t.Run(c.Name, func(t *testing.T) {
+			Chdir(t, t.TempDir())
+
+			var runs [][]string
+			p := profile.New(c.Options...)
+			p.Configure(
+				profile.WithLogger(Logger(t)),
+				profile.WithCommandRunner(func(name string, args ...string) error {
+					if filepath.Base(name) != "go" && filepath.Base(name) != "go.exe" {
+						t.Errorf("unexpected command %q", name)
+					}
+					runs = append(runs, args)
+					return nil
+				}),
+			)
+			p.Start().Stop()
+
+			if expect := [][]string{c.Expect}; !reflect.DeepEqual(runs, expect) {
+				t.Fatalf("got commands %v; expect %v", runs, expect)
+			}
+		})
+	}
+}
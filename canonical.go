@@ -0,0 +1,119 @@
+package profile
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	pprofile "github.com/google/pprof/profile"
+)
+
+// canonicalize returns a canonical form of prof, so that equivalent profiles
+// are encoded identically. Timestamps are cleared, as are addresses and mapping
+// ranges, since they vary between processes with address space layout
+// randomization. Locations that are then identical are combined. Samples,
+// locations, functions and mappings are sorted, although the first mapping,
+// which pprof treats as the main binary, is kept first. Modifies prof.
+func canonicalize(prof *pprofile.Profile) *pprofile.Profile {
+	for _, m := range prof.Mapping {
+		m.Start, m.Limit, m.Offset = 0, 0, 0
+	}
+	for _, l := range prof.Location {
+		l.Address = 0
+	}
+	prof = prof.Compact()
+
+	prof.TimeNanos = 0
+	prof.DurationNanos = 0
+
+	if len(prof.Mapping) > 1 {
+		rest := prof.Mapping[1:]
+		sort.SliceStable(rest, func(i, j int) bool {
+			return mappingkey(rest[i]) < mappingkey(rest[j])
+		})
+	}
+	sort.SliceStable(prof.Function, func(i, j int) bool {
+		return functionkey(prof.Function[i]) < functionkey(prof.Function[j])
+	})
+	sort.SliceStable(prof.Location, func(i, j int) bool {
+		return locationkey(prof.Location[i]) < locationkey(prof.Location[j])
+	})
+	sort.SliceStable(prof.Sample, func(i, j int) bool {
+		return samplekey(prof.Sample[i]) < samplekey(prof.Sample[j])
+	})
+
+	// Renumber, since object IDs are assigned by position.
+	for i, m := range prof.Mapping {
+		m.ID = uint64(i + 1)
+	}
+	for i, f := range prof.Function {
+		f.ID = uint64(i + 1)
+	}
+	for i, l := range prof.Location {
+		l.ID = uint64(i + 1)
+	}
+
+	return prof
+}
+
+func mappingkey(m *pprofile.Mapping) string {
+	return m.File + "\x00" + m.BuildID
+}
+
+func functionkey(f *pprofile.Function) string {
+	return strings.Join([]string{f.Name, f.SystemName, f.Filename, strconv.FormatInt(f.StartLine, 10)}, "\x00")
+}
+
+func locationkey(l *pprofile.Location) string {
+	key := ""
+	if l.Mapping != nil {
+		key = mappingkey(l.Mapping) + "@"
+	}
+	for _, ln := range l.Line {
+		key += functionkey(ln.Function) + ":" + strconv.FormatInt(ln.Line, 10) + ","
+	}
+	if l.IsFolded {
+		key += "!"
+	}
+	return key
+}
+
+func samplekey(s *pprofile.Sample) string {
+	keys := make([]string, len(s.Location))
+	for i, l := range s.Location {
+		keys[i] = locationkey(l)
+	}
+	values := make([]string, len(s.Value))
+	for i, v := range s.Value {
+		values[i] = strconv.FormatInt(v, 10)
+	}
+	return strings.Join(keys, ";") + "|" + labelkey(s) + "|" + strings.Join(values, ",")
+}
+
+// labelkey returns a string uniquely identifying the labels of s.
+func labelkey(s *pprofile.Sample) string {
+	var parts []string
+	for key, values := range s.Label {
+		parts = append(parts, key+"="+strings.Join(values, ","))
+	}
+	for key, values := range s.NumLabel {
+		var nums []string
+		for _, v := range values {
+			nums = append(nums, strconv.FormatInt(v, 10))
+		}
+		parts = append(parts, key+"#"+strings.Join(nums, ",")+strings.Join(s.NumUnit[key], ","))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ";")
+}
+
+// sampleindex returns the index of the sample value of prof with the given
+// type, or -1 if there is none.
+func sampleindex(prof *pprofile.Profile, typ string) int {
+	for i, st := range prof.SampleType {
+		if st.Type == typ {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,70 @@
+package profile_test
+
+import (
+	"bytes"
+	"runtime"
+	"runtime/pprof"
+	"testing"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/mmcloughlin/profile"
+)
+
+func TestCanonicalize(t *testing.T) {
+	h := HeapProfile(t)
+
+	// Make two copies of the profile, and reverse the order of the contents
+	// of one, other than the main binary mapping.
+	p, q := h.Copy(), h.Copy()
+	reverse(len(q.Sample), func(i, j int) { q.Sample[i], q.Sample[j] = q.Sample[j], q.Sample[i] })
+	reverse(len(q.Location), func(i, j int) { q.Location[i], q.Location[j] = q.Location[j], q.Location[i] })
+	reverse(len(q.Function), func(i, j int) { q.Function[i], q.Function[j] = q.Function[j], q.Function[i] })
+	if len(q.Mapping) > 1 {
+		rest := q.Mapping[1:]
+		reverse(len(rest), func(i, j int) { rest[i], rest[j] = rest[j], rest[i] })
+	}
+
+	// Canonical encodings should be identical.
+	if !bytes.Equal(Encode(t, profile.Canonicalize(p)), Encode(t, profile.Canonicalize(q))) {
+		t.Fatal("canonical encodings differ")
+	}
+}
+
+func reverse(n int, swap func(i, j int)) {
+	for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+		swap(i, j)
+	}
+}
+
+// HeapProfile captures a heap profile of the current process.
+func HeapProfile(t *testing.T) *pprofile.Profile {
+	t.Helper()
+
+	for i := 0; i < 1024; i++ {
+		sink = make([]byte, 1<<16)
+	}
+	runtime.GC()
+
+	buf := new(bytes.Buffer)
+	if err := pprof.Lookup("allocs").WriteTo(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	prof, err := pprofile.Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) == 0 {
+		t.Fatal("expected samples")
+	}
+	return prof
+}
+
+// Encode returns the encoding of prof.
+func Encode(t *testing.T, prof *pprofile.Profile) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if err := prof.WriteUncompressed(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,72 @@
+package profile
+
+import (
+	"flag"
+	"fmt"
+
+	pprofile "github.com/google/pprof/profile"
+)
+
+// Checkpoint captures the allocation profile in memory under the given label,
+// replacing any previous checkpoint with the same label. Allocations between
+// two checkpoints may then be written with WriteDiff, allowing allocations to
+// be analyzed phase by phase. Checkpoint may be called regardless of whether
+// profiling has been started.
+func (p *Profile) Checkpoint(label string) error {
+	p.memgc()
+	prof, err := captureprofile("allocs")
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.checkpoints == nil {
+		p.checkpoints = map[string]*pprofile.Profile{}
+	}
+	p.checkpoints[label] = prof
+	return nil
+}
+
+// WriteDiff writes the allocations made between checkpoints a and b to the
+// file at path, as an allocation profile. The output is written as profile
+// outputs are, so relative paths are resolved against the run and output
+// directories, if configured, and the file is recorded in the manifest under
+// the name "diff".
+func (p *Profile) WriteDiff(a, b, path string) (err error) {
+	p.mu.Lock()
+	from, to := p.checkpoints[a], p.checkpoints[b]
+	p.mu.Unlock()
+	if from == nil {
+		return fmt.Errorf("unknown checkpoint %q", a)
+	}
+	if to == nil {
+		return fmt.Errorf("unknown checkpoint %q", b)
+	}
+
+	diff, err := diffprofiles(from, to)
+	if err != nil {
+		return err
+	}
+	if p.minallocsize > 0 {
+		diff = p.filterallocs(diff)
+	}
+	if p.deterministic {
+		diff = canonicalize(diff)
+	}
+
+	// Write, retrying on transient errors.
+	d := &diffoutput{outfile: outfile{filename: path}}
+	return p.retrywrite(d, path, diff.Write)
+}
+
+// diffoutput is the method under which WriteDiff output is written.
+type diffoutput struct {
+	outfile
+}
+
+func (*diffoutput) Name() string           { return "diff" }
+func (*diffoutput) SetFlags(*flag.FlagSet) {}
+func (*diffoutput) Enabled() bool          { return false }
+func (*diffoutput) Start(*Profile) error   { return nil }
+func (*diffoutput) Stop(*Profile) error    { return nil }
@@ -0,0 +1,103 @@
+package profile_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/mmcloughlin/profile"
+)
+
+//go:noinline
+func allocphase() {
+	for i := 0; i < 256; i++ {
+		sink = make([]byte, 1<<16)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(profile.WithLogger(Logger(t)))
+
+	// Allocations before the first checkpoint should not appear in the diff.
+	allocbefore()
+	if err := p.Checkpoint("a"); err != nil {
+		t.Fatal(err)
+	}
+	allocphase()
+	if err := p.Checkpoint("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.WriteDiff("a", "b", "diff.pprof"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sum allocated space per function.
+	r, err := os.Open("diff.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	prof, err := pprofile.Parse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := SampleIndex(t, prof, "alloc_space")
+	space := map[string]int64{}
+	for _, s := range prof.Sample {
+		for _, ln := range s.Location[0].Line {
+			space[ln.Function.Name] += s.Value[index]
+		}
+	}
+
+	before := space["github.com/mmcloughlin/profile_test.allocbefore"]
+	phase := space["github.com/mmcloughlin/profile_test.allocphase"]
+	t.Logf("allocated before=%d phase=%d", before, phase)
+
+	if before != 0 {
+		t.Errorf("allocations before the first checkpoint appear in diff")
+	}
+	if phase <= 0 {
+		t.Errorf("expected allocations between checkpoints in diff")
+	}
+}
+
+func TestWriteDiffUnknownCheckpoint(t *testing.T) {
+	p := profile.New(profile.WithLogger(Logger(t)))
+	if err := p.WriteDiff("a", "b", "diff.pprof"); err == nil {
+		t.Fatal("expected error for unknown checkpoint")
+	}
+}
+
+func TestWriteDiffOutput(t *testing.T) {
+	fs := &FlakyFS{MemFS: NewMemFS(), Err: syscall.EAGAIN, Failures: 1}
+	p := profile.New(
+		profile.WithFilesystem(fs),
+		profile.WithWriteRetries(1),
+		profile.WithLogger(Logger(t)),
+	)
+
+	for _, label := range []string{"a", "b"} {
+		if err := p.Checkpoint(label); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.WriteDiff("a", "b", "diff.pprof"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the diff was written through the filesystem and counted.
+	size := int64(len(fs.Bytes("diff.pprof")))
+	if size == 0 {
+		t.Fatal("diff not written")
+	}
+	if n := p.BytesWritten()["diff"]; n != size {
+		t.Fatalf("BytesWritten() = %d; expect %d", n, size)
+	}
+}
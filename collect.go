@@ -0,0 +1,121 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pprofile "github.com/google/pprof/profile"
+)
+
+// Collect captures the named runtime profile, for example "heap" or
+// "goroutine", and returns it parsed in memory as a
+// github.com/google/pprof/profile Profile. This allows programs to analyze
+// their own profiles without writing files. The heap and allocs profiles are
+// preceded by a garbage collection, unless disabled by WithMemProfileNoGC.
+//
+// The cpu profile and execution trace require a profiling window, and cannot
+// be collected.
+func (p *Profile) Collect(name string) (*pprofile.Profile, error) {
+	switch name {
+	case "cpu", "trace":
+		return nil, fmt.Errorf("%s profile requires a profiling window and cannot be collected", name)
+	case "heap", "allocs":
+		p.memgc()
+	}
+	return captureprofile(name)
+}
+
+// StopAndOpen stops the named profile, leaving others running, and returns a
+// reader over its output. The output is copied to a temporary file, which is
+// removed when the reader is closed; the configured output file is kept. This
+// suits pipelines that immediately consume the profile, for example by an
+// analysis library. Only supported for output written to the operating system
+// filesystem: otherwise an error is returned without stopping the profile.
+func (p *Profile) StopAndOpen(name string) (io.ReadCloser, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m := p.runningmethod(name)
+	if m == nil {
+		return nil, fmt.Errorf("%s profile: not running", name)
+	}
+	fs, ok := p.fs.(opener)
+	if !ok || p.archive != nil || isurl(m.Filename()) {
+		return nil, fmt.Errorf("%s profile: output cannot be opened for reading", name)
+	}
+
+	err := p.stopmethod(m)
+	p.running = removemethod(p.running, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return opentemp(fs, p.methodpath(m, m.Filename()))
+}
+
+// removemethod returns ms without method m.
+func removemethod(ms []method, m method) []method {
+	var rest []method
+	for _, r := range ms {
+		if r != m {
+			rest = append(rest, r)
+		}
+	}
+	return rest
+}
+
+// opentemp copies the named file to a temporary file, and opens the copy for
+// reading. The copy is removed when the returned reader is closed.
+func opentemp(fs opener, name string) (_ io.ReadCloser, err error) {
+	r, err := fs.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ext := filepath.Ext(name)
+	f, err := ioutil.TempFile("", strings.TrimSuffix(filepath.Base(name), ext)+"-*"+ext)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close() // best effort: ignore error since we already have one
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &removecloser{ReadCloser: f, remove: func() error { return os.Remove(f.Name()) }}, nil
+}
+
+// opener is implemented by filesystems that can open files for reading.
+type opener interface {
+	open(name string) (io.ReadCloser, error)
+}
+
+func (osfs) open(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+// removecloser removes the underlying file after closing.
+type removecloser struct {
+	io.ReadCloser
+	remove func() error
+}
+
+func (r *removecloser) Close() error {
+	err := r.ReadCloser.Close()
+	if errr := r.remove(); err == nil {
+		err = errr
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package profile_test
+
+import (
+	"testing"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/mmcloughlin/profile"
+)
+
+func TestCollect(t *testing.T) {
+	p := profile.New(profile.WithLogger(Logger(t)))
+
+	prof, err := p.Collect("heap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := map[string]bool{}
+	for _, st := range prof.SampleType {
+		types[st.Type] = true
+	}
+	for _, expect := range []string{"alloc_objects", "alloc_space", "inuse_objects", "inuse_space"} {
+		if !types[expect] {
+			t.Errorf("missing sample type %q", expect)
+		}
+	}
+}
+
+func TestCollectErrors(t *testing.T) {
+	p := profile.New(profile.WithLogger(Logger(t)))
+	for _, name := range []string{"cpu", "trace", "unknown"} {
+		if _, err := p.Collect(name); err == nil {
+			t.Errorf("expected error collecting %q", name)
+		} else {
+			t.Logf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestStopAndOpen(t *testing.T) {
+	dir := t.TempDir()
+	tmp := t.TempDir()
+	Setenv(t, "TMPDIR", tmp)
+
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithOutputDir(dir),
+		profile.WithLogger(Logger(t)),
+	)
+	spin(50 * time.Millisecond)
+
+	r, err := p.StopAndOpen("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pprofile.Parse(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expect only the cpu profile to be stopped, and its output kept.
+	AssertDirContains(t, dir, []string{"cpu.pprof"})
+	if _, err := p.StopAndOpen("cpu"); err == nil {
+		t.Fatal("expected error opening stopped profile")
+	}
+
+	// Expect the temporary copy to be removed on close.
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	AssertDirContains(t, tmp, nil)
+
+	p.Stop()
+	AssertDirContains(t, dir, []string{"cpu.pprof", "mem.pprof"})
+}
+
+func TestStopAndOpenNotEnabled(t *testing.T) {
+	dir := t.TempDir()
+
+	p := profile.Start(profile.MemProfile, profile.WithOutputDir(dir), profile.WithLogger(Logger(t)))
+	defer p.Stop()
+
+	if _, err := p.StopAndOpen("cpu"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,22 @@
+package profile
+
+// MetricCollector receives updates about which profiles are running. It may be
+// used to bridge to a metrics system such as Prometheus or expvar, for example
+// to alert when profiling has been left enabled.
+type MetricCollector interface {
+	// SetRunning is called with running true when the named profile starts,
+	// and false when it stops.
+	SetRunning(name string, running bool)
+}
+
+// WithMetricsCollector configures c to be notified as profiles start and stop.
+func WithMetricsCollector(c MetricCollector) func(*Profile) {
+	return func(p *Profile) { p.collector = c }
+}
+
+// setrunning notifies the metrics collector, if configured.
+func (p *Profile) setrunning(m method, running bool) {
+	if p.collector != nil {
+		p.collector.SetRunning(m.Name(), running)
+	}
+}
@@ -0,0 +1,44 @@
+package profile_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestMetricsCollector(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	c := &FakeCollector{}
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithMetricsCollector(c),
+		profile.WithLogger(Logger(t)),
+	)
+
+	expect := []string{"mem=true", "cpu=true"}
+	if !reflect.DeepEqual(c.calls, expect) {
+		t.Fatalf("after start got calls %v; expect %v", c.calls, expect)
+	}
+
+	p.Stop()
+
+	expect = append(expect, "cpu=false", "mem=false")
+	if !reflect.DeepEqual(c.calls, expect) {
+		t.Fatalf("after stop got calls %v; expect %v", c.calls, expect)
+	}
+}
+
+// FakeCollector records calls to SetRunning.
+type FakeCollector struct {
+	calls []string
+}
+
+// SetRunning records the call.
+func (c *FakeCollector) SetRunning(name string, running bool) {
+	c.calls = append(c.calls, fmt.Sprintf("%s=%v", name, running))
+}
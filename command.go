@@ -0,0 +1,58 @@
+package profile
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// CommandEnvVar is the environment variable used by Command to configure
+// profiling in a child process.
+const CommandEnvVar = "PROFILE"
+
+// fileflagger is implemented by methods with an output file flag.
+type fileflagger interface {
+	fileflagname() string
+	setfileflagname(name string)
+}
+
+// Command returns a command to run the named program with the profiles
+// enabled in this session also enabled in the child process. The child must
+// use this package configured with ConfigEnvVar(CommandEnvVar), and the same
+// profiles available. Output files of the child are written alongside this
+// session's, prefixed with the base name of the program. For example, the cpu
+// profile of the program "worker" is written to worker-cpu.pprof. The ".exe"
+// extension of the program name, if any, is omitted from the prefix. Other
+// settings, such as profiling rates, take the child's defaults. Since settings
+// are passed as a comma-separated list, profiles with output paths containing
+// commas are not enabled in the child, and an error is logged.
+//
+// As with exec.Command, the caller is responsible for running the command.
+func (p *Profile) Command(name string, args ...string) *exec.Cmd {
+	p.setdefaults()
+
+	prefix := strings.TrimSuffix(filepath.Base(name), ".exe") + "-"
+	var cfg []string
+	for _, m := range p.methods {
+		f, ok := m.(fileflagger)
+		if !ok || !m.Enabled() {
+			continue
+		}
+
+		dir, base := filepath.Split(m.Filename())
+		filename := p.methodpath(m, filepath.Join(dir, prefix+base))
+		if abs, err := filepath.Abs(filename); err == nil {
+			filename = abs
+		}
+		if strings.Contains(filename, ",") {
+			p.log("command: %s profile: output path %q contains a comma: not enabled in child", m.Name(), filename)
+			continue
+		}
+		cfg = append(cfg, f.fileflagname()+"="+filename)
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), CommandEnvVar+"="+strings.Join(cfg, ","))
+	return cmd
+}
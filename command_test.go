@@ -0,0 +1,77 @@
+package profile_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestCommand(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds child program")
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Build a child program that is configured by environment variable.
+	bin := filepath.Join(t.TempDir(), "worker")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	build := exec.Command("go", "build", "-o", bin, "github.com/mmcloughlin/profile/internal/example/env")
+	build.Dir = root
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build child: %v\n%s", err, out)
+	}
+
+	// Run the child with profiling configured by the parent.
+	p := profile.New(
+		profile.CPUProfile,
+		profile.WithMemProfileFile("mem.out"),
+		profile.WithOutputDir(dir),
+		profile.WithLogger(Logger(t)),
+	)
+
+	cmd := p.Command(bin, "-n", "1000")
+	out, err := cmd.CombinedOutput()
+	t.Logf("child output:\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AssertDirContains(t, dir, []string{"worker-cpu.pprof", "worker-mem.out"})
+}
+
+func TestCommandCommaPath(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.CPUProfile,
+		profile.WithMemProfileFile("a,b.out"),
+		profile.WithLogger(Logger(t)),
+	)
+	cmd := p.Command("worker")
+
+	// Expect the memory profile to be omitted from the child's configuration.
+	var cfg string
+	for _, env := range cmd.Env {
+		if strings.HasPrefix(env, profile.CommandEnvVar+"=") {
+			cfg = strings.TrimPrefix(env, profile.CommandEnvVar+"=")
+		}
+	}
+	if !strings.HasPrefix(cfg, "cpuprofile=") || strings.Contains(cfg, "memprofile") {
+		t.Fatalf("unexpected configuration %q", cfg)
+	}
+}
@@ -0,0 +1,152 @@
+package profile
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ConfigSource provides configuration in the key-value format accepted by
+// ConfigEnvVar, for example "cpuprofile=cpu.out,memprofile=mem.out".
+type ConfigSource func() (string, error)
+
+// EnvVar is a configuration source that reads the given environment variable.
+func EnvVar(key string) ConfigSource {
+	return func() (string, error) {
+		return os.Getenv(key), nil
+	}
+}
+
+// File is a configuration source that reads the given file. Key-value pairs
+// may be separated by commas or newlines. A missing file is treated as empty.
+func File(filename string) ConfigSource {
+	return func() (string, error) {
+		b, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		var pairs []string
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				pairs = append(pairs, line)
+			}
+		}
+
+		return strings.Join(pairs, ","), nil
+	}
+}
+
+// ConfigFile specifies a file to configure profiles from. Equivalent to
+// ConfigSources(File(filename)).
+func ConfigFile(filename string) func(*Profile) {
+	return ConfigSources(File(filename))
+}
+
+// ConfigSources specifies sources to configure profiles from, when profiling
+// is started. Configuration is layered in the following order, with later
+// layers taking precedence over earlier ones:
+//
+//  1. Options applied in code, such as WithCPUProfileFile.
+//  2. Configuration sources, in the order they were specified. Sources added
+//     by ConfigEnvVar, ConfigEnvPrefix, ConfigFile and ConfigSources
+//     accumulate.
+//  3. Flags registered with SetFlags and explicitly set on the command line.
+func ConfigSources(sources ...ConfigSource) func(*Profile) {
+	return func(p *Profile) {
+		for _, source := range sources {
+			source := source // scopelint
+			p.sources = append(p.sources, func() error {
+				cfg, err := source()
+				if err != nil {
+					return err
+				}
+				p.config(cfg)
+				return nil
+			})
+		}
+	}
+}
+
+// ConfigEnvPrefix specifies a prefix of environment variables to configure
+// individual profiles from. For each configured profile, the variable
+// <PREFIX>_<NAME>_FILE sets its output file and <PREFIX>_<NAME>_RATE sets its
+// sampling rate, if it has one. Profiles must already be configured, for
+// example with AllProfiles, and as with other configuration sources, those
+// without an output file set in code or by a source are disabled. For example,
+// with prefix "PROFILE" and AllProfiles, the variable PROFILE_CPU_FILE enables
+// the cpu profile and PROFILE_MUTEX_RATE sets the mutex profile fraction.
+// Values are applied as they are, so may contain any character. Variables are
+// read when profiling is started, and layered with other configuration sources
+// as described by ConfigSources, so flags explicitly set on the command line
+// take precedence.
+func ConfigEnvPrefix(prefix string) func(*Profile) {
+	return func(p *Profile) {
+		p.sources = append(p.sources, func() error {
+			p.configenv(prefix)
+			return nil
+		})
+	}
+}
+
+// configenv configures profiles from per-profile environment variables with the
+// given prefix. Flags explicitly set on the command line take precedence.
+func (p *Profile) configenv(prefix string) {
+	explicit := p.explicitflags()
+
+	for _, m := range p.methods {
+		flags := p.methodflags(m)
+		name := prefix + "_" + strings.ToUpper(m.Name())
+
+		if f, ok := m.(fileflagger); ok {
+			if filename := os.Getenv(name + "_FILE"); filename != "" {
+				p.setenvflag(flags, name+"_FILE", f.fileflagname(), filename)
+			}
+		}
+
+		if rate := os.Getenv(name + "_RATE"); rate != "" {
+			key := ratekey(flags)
+			if key == "" {
+				p.log("config: %s_RATE: %s profile has no rate", name, m.Name())
+				continue
+			}
+			p.setenvflag(flags, name+"_RATE", key, rate)
+		}
+	}
+
+	// Restore command-line values.
+	for v, s := range explicit {
+		_ = v.Set(s) // value was previously accepted by Set
+	}
+}
+
+// setenvflag sets the named flag, among the flags of a method, to value read
+// from the environment variable env.
+func (p *Profile) setenvflag(flags []*flag.Flag, env, name, value string) {
+	for _, opt := range flags {
+		if opt.Name != name {
+			continue
+		}
+		if err := opt.Value.Set(value); err != nil {
+			p.log("config: invalid value %q for %s: %v", value, env, err)
+			p.starterror(fmt.Errorf("config: invalid value %q for %s: %w", value, env, err))
+		}
+		return
+	}
+}
+
+// ratekey returns the name of the flag that configures the sampling rate, among
+// the flags of a method, or the empty string if there is none.
+func ratekey(flags []*flag.Flag) string {
+	for _, opt := range flags {
+		if strings.HasSuffix(opt.Name, "rate") || strings.HasSuffix(opt.Name, "fraction") {
+			return opt.Name
+		}
+	}
+	return ""
+}
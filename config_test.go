@@ -0,0 +1,111 @@
+package profile_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestConfigSourcesLayering(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Configuration file.
+	cfgfile := filepath.Join(t.TempDir(), "profile.cfg")
+	cfg := "cpuprofile=file.cpu\nmemprofile=file.mem\ntrace=file.trace\n"
+	if err := ioutil.WriteFile(cfgfile, []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Environment variable.
+	key := "PROFILE_LAYERING"
+	Setenv(t, key, "memprofile=env.mem")
+
+	p := profile.New(
+		profile.AllProfiles,
+		profile.WithCPUProfileFile("code.cpu"),
+		profile.WithGoroutineProfileFile("code.goroutine"),
+		profile.ConfigSources(profile.File(cfgfile), profile.EnvVar(key)),
+		profile.WithLogger(Logger(t)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-trace=flag.trace"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	AssertDirContains(t, dir, []string{
+		"code.goroutine", // code only
+		"file.cpu",       // file overrides code
+		"env.mem",        // env overrides file
+		"flag.trace",     // flag overrides file
+	})
+}
+
+func TestConfigFileMissing(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	profile.Start(
+		profile.AllProfiles,
+		profile.ConfigFile(filepath.Join(dir, "missing.cfg")),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	AssertDirContains(t, dir, nil)
+}
+
+func TestConfigEnvPrefix(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	Setenv(t, "PROFILE_ENVPREFIX_CPU_FILE", "env.cpu")
+	Setenv(t, "PROFILE_ENVPREFIX_MEM_FILE", "env.mem")
+	Setenv(t, "PROFILE_ENVPREFIX_MEM_RATE", "2048")
+	Setenv(t, "PROFILE_ENVPREFIX_TRACE_RATE", "1")
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.AllProfiles,
+		profile.ConfigEnvPrefix("PROFILE_ENVPREFIX"),
+		profile.WithConfigDump(),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	t.Log(buf.String())
+	for _, expect := range []string{
+		"config: mem: memprofilerate=2048",
+		"config: PROFILE_ENVPREFIX_TRACE_RATE: trace profile has no rate",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected %q in output", expect)
+		}
+	}
+
+	AssertDirContains(t, dir, []string{"env.cpu", "env.mem"})
+}
+
+func TestConfigEnvPrefixComma(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Values containing commas are applied as they are.
+	Setenv(t, "PROFILE_ENVCOMMA_CPU_FILE", "a,b.cpu")
+
+	profile.Start(
+		profile.AllProfiles,
+		profile.ConfigEnvPrefix("PROFILE_ENVCOMMA"),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	AssertDirContains(t, dir, []string{"a,b.cpu"})
+}
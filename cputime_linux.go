@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package profile
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// clocktick is the unit of process times in /proc, USER_HZ. This is 100 on
+// all supported Linux architectures.
+const clocktick = time.Second / 100
+
+// cputime returns the total user and system CPU time consumed by the process.
+func cputime() (time.Duration, error) {
+	b, err := ioutil.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0, err
+	}
+
+	// Fields follow the command name, which is in parentheses and may itself
+	// contain spaces. Reference: proc(5).
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, errors.New("malformed /proc/self/stat")
+	}
+	fields := bytes.Fields(b[i+1:])
+
+	// The first field after the command is the state, field 3. User and system
+	// times are fields 14 and 15.
+	const utime, stime = 14 - 3, 15 - 3
+	if len(fields) <= stime {
+		return 0, errors.New("malformed /proc/self/stat")
+	}
+
+	var total time.Duration
+	for _, field := range [][]byte{fields[utime], fields[stime]} {
+		ticks, err := strconv.ParseUint(string(field), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(ticks) * clocktick
+	}
+
+	return total, nil
+}
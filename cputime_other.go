@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package profile
+
+import (
+	"errors"
+	"time"
+)
+
+// cputime returns the total user and system CPU time consumed by the process.
+func cputime() (time.Duration, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -0,0 +1,45 @@
+package profile
+
+import (
+	"io"
+	"net/url"
+	"os"
+
+	pprofile "github.com/google/pprof/profile"
+)
+
+// WithExit configures the function called by the shutdown hook to exit the
+// program.
+func WithExit(exit func(int)) func(*Profile) {
+	return func(p *Profile) { p.exit = exit }
+}
+
+// WithNotifier configures the functions used by the shutdown hook to register
+// for, and stop, signal notifications.
+func WithNotifier(notify func(chan<- os.Signal, ...os.Signal), stop func(chan<- os.Signal)) func(*Profile) {
+	return func(p *Profile) {
+		p.notify = notify
+		p.stopnotify = stop
+	}
+}
+
+// WithCommandRunner configures the function used to run external commands.
+func WithCommandRunner(run func(string, ...string) error) func(*Profile) {
+	return func(p *Profile) { p.run = run }
+}
+
+// WithStderr configures the writer used in place of standard error.
+func WithStderr(w io.Writer) func(*Profile) {
+	return func(p *Profile) { p.stderr = w }
+}
+
+// Shutdown runs the shutdown hook as if signal s had been received.
+func (p *Profile) Shutdown(s os.Signal) { p.shutdown(s) }
+
+// FileURLPath returns the local path of the file URL u on the operating system
+// goos.
+func FileURLPath(u *url.URL, goos string) string { return fileurlpath(u, goos) }
+
+// Canonicalize sorts prof into a canonical order, as WithDeterministicOutput
+// does before writing.
+func Canonicalize(prof *pprofile.Profile) *pprofile.Profile { return canonicalize(prof) }
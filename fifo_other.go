@@ -0,0 +1,17 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package profile
+
+import (
+	"errors"
+	"io"
+)
+
+// isfifo reports whether name is an existing named pipe.
+func isfifo(name string) bool { return false }
+
+// openfifo opens the named pipe for writing.
+func openfifo(name string) (io.WriteCloser, error) {
+	return nil, errors.New("named pipes not supported")
+}
@@ -0,0 +1,32 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// isfifo reports whether name is an existing named pipe.
+func isfifo(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+// openfifo opens the named pipe for writing. Opening a pipe for writing
+// blocks until it has a reader, so it is opened in non-blocking mode and fails
+// if there is no reader yet, rather than hanging.
+func openfifo(name string) (io.WriteCloser, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ENXIO) {
+		return nil, fmt.Errorf("named pipe %s has no reader", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,68 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package profile_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/mmcloughlin/profile"
+)
+
+func TestNamedPipe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpu.pipe")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Open for reading without blocking, since there is no writer yet.
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	p := profile.Start(profile.WithCPUProfileFile(path), profile.WithLogger(Logger(t)))
+
+	// Read the stream concurrently, since it may exceed the pipe buffer.
+	type result struct {
+		b   []byte
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		b, err := ioutil.ReadAll(r)
+		done <- result{b, err}
+	}()
+
+	spin(50 * time.Millisecond)
+	p.Stop()
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if _, err := pprofile.Parse(bytes.NewReader(res.b)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamedPipeNoReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpu.pipe")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := profile.New(profile.WithCPUProfileFile(path), profile.WithLogger(Logger(t)))
+	if err := p.TryStart(); err == nil {
+		t.Fatal("expected error without reader")
+	}
+	p.Stop()
+}
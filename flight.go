@@ -0,0 +1,67 @@
+package profile
+
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
+// FlightRecorderProfile enables the execution trace flight recorder, which
+// continuously records the execution trace in memory, retaining roughly the
+// most recent window of it. The window is written to the output file at Stop,
+// including when stopped by the shutdown hook on interrupt, and by Snapshot.
+// This captures post-incident traces without continuous disk writes. Requires
+// Go 1.25 or later: on earlier versions the profile fails to start.
+func FlightRecorderProfile(window time.Duration) func(*Profile) {
+	return func(p *Profile) {
+		p.addmethod(&flightrecorder{
+			window:  window,
+			outfile: outfile{filename: "flight.trace", flag: "flightrecorder"},
+		})
+	}
+}
+
+// WithFlightRecorderFile enables the execution trace flight recorder to the
+// given file, with the default window.
+func WithFlightRecorderFile(filename string) func(*Profile) {
+	return withfile("flightrecorder", FlightRecorderProfile(0), filename)
+}
+
+type flightrecorder struct {
+	outfile
+	window time.Duration
+
+	fr *recorder
+}
+
+func (*flightrecorder) Name() string { return "flightrecorder" }
+
+func (r *flightrecorder) SetFlags(f *flag.FlagSet) {
+	r.fileflag(f, "write the most recent window of the execution trace to `file`")
+	f.DurationVar(&r.window, "flightrecorderwindow", r.window, "retain at least `duration` of the execution trace in the flight recorder")
+}
+
+func (r *flightrecorder) Enabled() bool { return r.filename != "" }
+
+func (r *flightrecorder) Start(*Profile) error {
+	fr, err := startrecorder(r.window)
+	if err != nil {
+		return err
+	}
+	r.fr = fr
+	return nil
+}
+
+func (r *flightrecorder) Stop(p *Profile) error {
+	err := r.snapshot(p, r.filename)
+	r.fr.stop()
+	r.fr = nil
+	return err
+}
+
+func (r *flightrecorder) snapshot(p *Profile, filename string) error {
+	if r.fr == nil {
+		return errors.New("not running")
+	}
+	return p.writefile(r, filename, r.fr.writeto)
+}
@@ -0,0 +1,32 @@
+//go:build go1.25
+// +build go1.25
+
+package profile
+
+import (
+	"io"
+	"runtime/trace"
+	"time"
+)
+
+// recorder is a running execution trace flight recorder.
+type recorder struct {
+	fr *trace.FlightRecorder
+}
+
+// startrecorder starts a flight recorder retaining at least the given window
+// of the execution trace. A zero window uses the runtime default.
+func startrecorder(window time.Duration) (*recorder, error) {
+	fr := trace.NewFlightRecorder(trace.FlightRecorderConfig{MinAge: window})
+	if err := fr.Start(); err != nil {
+		return nil, err
+	}
+	return &recorder{fr: fr}, nil
+}
+
+func (r *recorder) writeto(w io.Writer) error {
+	_, err := r.fr.WriteTo(w)
+	return err
+}
+
+func (r *recorder) stop() { r.fr.Stop() }
@@ -0,0 +1,42 @@
+//go:build go1.25
+// +build go1.25
+
+package profile_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestFlightRecorderProfile(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	window := 100 * time.Millisecond
+	p := profile.Start(
+		profile.FlightRecorderProfile(window),
+		profile.WithLogger(Logger(t)),
+	)
+
+	// Generate trace events for longer than the window.
+	deadline := time.Now().Add(2 * window)
+	for time.Now().Before(deadline) {
+		contend()
+	}
+
+	p.Stop()
+
+	AssertDirContains(t, dir, []string{"flight.trace"})
+
+	b, err := ioutil.ReadFile("flight.trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("go 1.")) {
+		t.Fatal("trace does not have expected header")
+	}
+}
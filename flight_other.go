@@ -0,0 +1,22 @@
+//go:build !go1.25
+// +build !go1.25
+
+package profile
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// recorder is a running execution trace flight recorder.
+type recorder struct{}
+
+// startrecorder reports that the flight recorder is not supported.
+func startrecorder(time.Duration) (*recorder, error) {
+	return nil, errors.New("flight recorder requires go1.25 or later")
+}
+
+func (*recorder) writeto(io.Writer) error { return errors.New("not supported") }
+
+func (*recorder) stop() {}
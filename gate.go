@@ -0,0 +1,52 @@
+package profile
+
+import "time"
+
+// WithGate configures cpu profiling to run only while pred returns true. The
+// predicate is polled every interval: cpu profiling starts when it becomes true
+// and stops when it becomes false. Since cpu profiles cannot be paused, each
+// window of profiling is written to a separate numbered file. For example, with
+// the default filename windows are written to cpu-0001.pprof, cpu-0002.pprof
+// and so on.
+func WithGate(pred func() bool, interval time.Duration) func(*Profile) {
+	return func(p *Profile) {
+		p.gate = pred
+		p.gateinterval = interval
+	}
+}
+
+func (c *cpu) startgate(p *Profile) {
+	c.window = 0
+	c.poller = poll(p.gateinterval, func() { c.poll(p) })
+}
+
+// poll checks the gate predicate, and starts or stops a profiling window if it
+// has changed.
+func (c *cpu) poll(p *Profile) {
+	open := p.gate()
+	switch {
+	case open && c.f == nil:
+		c.window++
+		filename := seqfilename(c.filename, c.window)
+		if err := c.start(p, filename); err != nil {
+			p.log("%s profile: error starting window: %v", c.Name(), err)
+			return
+		}
+		p.info("%s profile: gate opened: writing %s", c.Name(), filename)
+	case !open && c.f != nil:
+		if err := c.stop(p); err != nil {
+			p.log("%s profile: error stopping window: %v", c.Name(), err)
+			return
+		}
+		p.info("%s profile: gate closed", c.Name())
+	}
+}
+
+func (c *cpu) stopgate(p *Profile) error {
+	c.poller.stop()
+	c.poller = nil
+	if c.f != nil {
+		return c.stop(p)
+	}
+	return nil
+}
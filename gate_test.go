@@ -0,0 +1,34 @@
+package profile_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithGate(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	var open int32
+	pred := func() bool { return atomic.LoadInt32(&open) != 0 }
+
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.WithGate(pred, time.Millisecond),
+		profile.WithLogger(Logger(t)),
+	)
+
+	// Toggle the gate: open, closed, open.
+	for _, state := range []int32{1, 0, 1} {
+		atomic.StoreInt32(&open, state)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	p.Stop()
+
+	// Expect one file per window.
+	AssertDirContains(t, dir, []string{"cpu-0001.pprof", "cpu-0002.pprof"})
+}
@@ -1,3 +1,5 @@
 module github.com/mmcloughlin/profile
 
 go 1.15
+
+require github.com/google/pprof v0.0.0-20210720184732-4bb14d4b1be1
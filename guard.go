@@ -0,0 +1,58 @@
+package profile
+
+import (
+	"runtime"
+	"time"
+)
+
+// WithMemoryLimitGuard configures a heap profile to be written when the heap
+// grows beyond limitBytes, as a forensic snapshot should the process go on to
+// run out of memory. The heap size is polled in the background while profiling
+// is running, and the profile is written to heap-guard.pprof with a warning
+// logged. If the heap shrinks below the limit and then exceeds it again, the
+// profile is rewritten.
+func WithMemoryLimitGuard(limitBytes uint64) func(*Profile) {
+	return func(p *Profile) { p.memlimit = limitBytes }
+}
+
+// guardinterval is how often the memory limit guard checks the heap size.
+const guardinterval = 100 * time.Millisecond
+
+// startguard starts the memory limit guard, if configured.
+func (p *Profile) startguard() {
+	if p.memlimit == 0 || p.dryrun {
+		return
+	}
+
+	heap := &lookup{
+		name:    "heap",
+		long:    "heap",
+		outfile: outfile{filename: "heap-guard.pprof"},
+	}
+	exceeded := false
+	p.guard = poll(guardinterval, func() {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc < p.memlimit {
+			exceeded = false
+			return
+		}
+		if exceeded {
+			return
+		}
+		exceeded = true
+
+		p.log("memory limit guard: heap size %d exceeds limit %d: writing %s", stats.HeapAlloc, p.memlimit, heap.filename)
+		if err := p.writeprofile(heap, heap.name, heap.filename, 0); err != nil {
+			p.log("memory limit guard: error writing heap profile: %v", err)
+		}
+	})
+}
+
+// stopguard stops the memory limit guard, if running.
+func (p *Profile) stopguard() {
+	if p.guard != nil {
+		p.guard.stop()
+		p.guard = nil
+	}
+}
@@ -0,0 +1,37 @@
+package profile_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithMemoryLimitGuard(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	limit := stats.HeapAlloc + 16<<20
+
+	p := profile.Start(
+		profile.GoroutineProfile,
+		profile.WithMemoryLimitGuard(limit),
+		profile.WithLogger(Logger(t)),
+	)
+
+	// Allocate past the limit, and give the guard time to notice.
+	retained := make([][]byte, 0, 32)
+	for i := 0; i < 32; i++ {
+		retained = append(retained, make([]byte, 1<<20))
+	}
+	time.Sleep(300 * time.Millisecond)
+	runtime.KeepAlive(retained)
+
+	p.Stop()
+
+	AssertDirContains(t, dir, []string{"goroutine.pprof", "heap-guard.pprof"})
+}
@@ -0,0 +1,73 @@
+package profile
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPHandler serves h on addr while profiling is running, from a dedicated
+// server. The address may be overridden with the -pprofaddr flag. See the
+// httpprofile subpackage to serve the net/http/pprof handlers, so profiles can
+// be collected on demand.
+func HTTPHandler(addr string, h http.Handler) func(*Profile) {
+	return func(p *Profile) {
+		p.addmethod(&httpserver{addr: addr, handler: h})
+	}
+}
+
+// httpshutdowntimeout is the maximum time to wait for in-flight requests when
+// the server is stopped.
+const httpshutdowntimeout = 5 * time.Second
+
+type httpserver struct {
+	addr    string
+	handler http.Handler
+
+	srv  *http.Server
+	done chan error
+}
+
+func (*httpserver) Name() string       { return "http" }
+func (*httpserver) Filename() string   { return "" }
+func (*httpserver) setfilename(string) {}
+
+func (h *httpserver) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&h.addr, "pprofaddr", h.addr, "serve profiling handlers on `address`")
+}
+
+func (h *httpserver) Enabled() bool { return h.addr != "" }
+
+func (h *httpserver) Start(p *Profile) error {
+	// Listen first, so errors are reported at Start.
+	ln, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		return err
+	}
+
+	h.srv = &http.Server{Handler: h.handler}
+	h.done = make(chan error, 1)
+	go func() {
+		h.done <- h.srv.Serve(ln)
+	}()
+
+	p.info("%s profile: serving on http://%s/", h.Name(), ln.Addr())
+
+	return nil
+}
+
+func (h *httpserver) Stop(*Profile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), httpshutdowntimeout)
+	defer cancel()
+
+	err := h.srv.Shutdown(ctx)
+	if errs := <-h.done; !errors.Is(errs, http.ErrServerClosed) && err == nil {
+		err = errs
+	}
+	h.srv = nil
+
+	return err
+}
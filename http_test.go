@@ -0,0 +1,58 @@
+package profile_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	})
+
+	buf := new(bytes.Buffer)
+	p := profile.Start(
+		profile.HTTPHandler("127.0.0.1:0", handler),
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+	defer p.Stop()
+
+	// Determine the URL from the log output.
+	t.Log(buf.String())
+	url := regexp.MustCompile(`http://\S+`).FindString(buf.String())
+	if url == "" {
+		t.Fatal("could not find server url in log output")
+	}
+
+	// Fetch.
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s", res.Status)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("got body %q; expect %q", body, "hello")
+	}
+
+	// Expect the server to be shutdown on stop.
+	p.Stop()
+	if _, err := http.Get(url); err == nil {
+		t.Fatal("expected error after server stopped")
+	}
+}
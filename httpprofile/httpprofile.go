@@ -0,0 +1,38 @@
+// Package httpprofile serves the net/http/pprof handlers while profiling is
+// running.
+//
+// This is a separate package since importing net/http/pprof registers its
+// handlers on http.DefaultServeMux, which would expose profiling endpoints in
+// any program serving the default mux.
+package httpprofile
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/mmcloughlin/profile"
+)
+
+// Serve serves the net/http/pprof handlers on addr while profiling is running.
+// This allows profiles to be collected on demand with go tool pprof, for
+// example:
+//
+//	go tool pprof http://localhost:6060/debug/pprof/heap
+//
+// The handlers are served by a dedicated server. Note that importing this
+// package also registers the handlers on http.DefaultServeMux.
+func Serve(addr string) func(*profile.Profile) {
+	return profile.HTTPHandler(addr, Handler())
+}
+
+// Handler returns a handler serving the net/http/pprof handlers under
+// /debug/pprof/.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,48 @@
+package httpprofile_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+	"github.com/mmcloughlin/profile/httpprofile"
+)
+
+func TestServe(t *testing.T) {
+	buf := new(bytes.Buffer)
+	p := profile.Start(
+		httpprofile.Serve("127.0.0.1:0"),
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+	defer p.Stop()
+
+	// Determine the URL from the log output.
+	t.Log(buf.String())
+	url := regexp.MustCompile(`http://\S+`).FindString(buf.String())
+	if url == "" {
+		t.Fatal("could not find server url in log output")
+	}
+
+	// Fetch the index.
+	res, err := http.Get(url + "debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s", res.Status)
+	}
+	if !bytes.Contains(body, []byte("goroutine")) {
+		t.Fatal("expected index to list goroutine profile")
+	}
+}
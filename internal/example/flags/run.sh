@@ -1,3 +1,7 @@
+# Omit log lines that vary between runs: the parallelism logged by the cpu
+# profile, and the profiling duration.
+{
 example -n 1000000000 -cpuprofile cpu.out -memprofile mem.out
+} 2>&1 | grep -v -e GOMAXPROCS -e 'stopped after' >&2
 
 rm cpu.out mem.out
@@ -1,3 +1,7 @@
+# Omit log lines that vary between runs: the parallelism logged by the cpu
+# profile, and the profiling duration.
+{
 example
+} 2>&1 | grep -v -e GOMAXPROCS -e 'stopped after' >&2
 
 rm cpu.pprof mem.pprof
@@ -0,0 +1,52 @@
+package profile
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// Label returns a context with the given profiler labels added, specified as
+// alternating key-value pairs. Labels are attached to cpu profile samples
+// recorded while running code with the context in Do, allowing a single
+// profile to be sliced by label.
+func Label(ctx context.Context, labels ...string) context.Context {
+	return pprof.WithLabels(ctx, pprof.Labels(labels...))
+}
+
+// Do calls fn with a context carrying the given profiler labels, specified as
+// alternating key-value pairs. Goroutines started by fn inherit the labels. See
+// runtime/pprof.Do.
+func Do(ctx context.Context, labels []string, fn func(context.Context)) {
+	pprof.Do(ctx, pprof.Labels(labels...), fn)
+}
+
+// WithScopedLabels configures profiler labels, specified as alternating
+// key-value pairs, to be set on the goroutine that calls Start. Goroutines it
+// subsequently starts inherit the labels. For example, a library can label
+// its own work with WithScopedLabels("component", "ingest"), so that its cpu
+// profile samples can be filtered from the rest of the program. Labels only
+// scope filtering of samples: the whole program is still profiled.
+//
+// Labels replace any labels already set on the goroutine, and are cleared when
+// profiling stops. Stop should be called from the same goroutine as Start for
+// the labels to be cleared.
+func WithScopedLabels(labels ...string) func(*Profile) {
+	return func(p *Profile) { p.scopedlabels = labels }
+}
+
+// setscopedlabels sets the configured labels on the calling goroutine.
+func (p *Profile) setscopedlabels() {
+	if len(p.scopedlabels) == 0 {
+		return
+	}
+	pprof.SetGoroutineLabels(Label(context.Background(), p.scopedlabels...))
+	p.labelled = true
+}
+
+// clearscopedlabels clears labels from the calling goroutine, if set.
+func (p *Profile) clearscopedlabels() {
+	if p.labelled {
+		pprof.SetGoroutineLabels(context.Background())
+		p.labelled = false
+	}
+}
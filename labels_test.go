@@ -0,0 +1,91 @@
+package profile_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/mmcloughlin/profile"
+)
+
+func TestDo(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(profile.CPUProfile, profile.WithLogger(Logger(t)))
+
+	// Run busy work with labels.
+	ctx := profile.Label(context.Background(), "component", "test")
+	profile.Do(ctx, []string{"handler", "busy"}, func(context.Context) {
+		spin(500 * time.Millisecond)
+	})
+
+	p.Stop()
+
+	// Confirm labels appear in samples.
+	f, err := os.Open("cpu.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	prof, err := pprofile.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, s := range prof.Sample {
+		c, h := s.Label["component"], s.Label["handler"]
+		if len(c) == 1 && c[0] == "test" && len(h) == 1 && h[0] == "busy" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("labels not found in profile samples")
+	}
+}
+
+var spinsink int
+
+// spin keeps the CPU busy for duration d.
+func spin(d time.Duration) {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		for i := 0; i < 1000; i++ {
+			spinsink += i
+		}
+	}
+}
+
+func TestWithScopedLabels(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	labelled := func() bool {
+		buf := new(bytes.Buffer)
+		if err := pprof.Lookup("goroutine").WriteTo(buf, 1); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Contains(buf.String(), `"component":"scoped"`)
+	}
+
+	p := profile.Start(
+		profile.GoroutineProfile,
+		profile.WithScopedLabels("component", "scoped"),
+		profile.WithLogger(Logger(t)),
+	)
+	if !labelled() {
+		t.Fatal("expected labels during profiling")
+	}
+	p.Stop()
+
+	if labelled() {
+		t.Fatal("expected labels to be cleared after profiling")
+	}
+}
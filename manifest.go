@@ -0,0 +1,184 @@
+package profile
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// WithManifest configures a JSON manifest describing the profiling session to
+// be written to path when profiling stops. The manifest records the start and
+// stop times, the Go version, and for each profile started its output files
+// with their sizes, and any error. Output file paths are resolved, including
+// output directories and sequence numbers. If output is written to an archive,
+// paths are names of entries in the archive.
+func WithManifest(path string) func(*Profile) {
+	return func(p *Profile) { p.manifestpath = path }
+}
+
+// WithRecordArgs configures the command-line arguments of the process, from
+// os.Args, to be logged when profiling starts and recorded in the manifest, if
+// configured. This records how the profiled run was invoked. Arguments are
+// recorded verbatim unless a redactor is configured with WithArgsRedactor.
+func WithRecordArgs() func(*Profile) {
+	return func(p *Profile) { p.recordargs = true }
+}
+
+// WithArgsRedactor configures a function to be applied to each command-line
+// argument recorded with WithRecordArgs, for example to mask secrets passed as
+// flags.
+func WithArgsRedactor(redact func(arg string) string) func(*Profile) {
+	return func(p *Profile) { p.redactarg = redact }
+}
+
+// args returns the command-line arguments to record, or nil if not configured.
+func (p *Profile) args() []string {
+	if !p.recordargs {
+		return nil
+	}
+	args := append([]string(nil), os.Args...)
+	if p.redactarg != nil {
+		for i := range args {
+			args[i] = p.redactarg(args[i])
+		}
+	}
+	return args
+}
+
+// manifest describes a profiling session.
+type manifest struct {
+	Name      string             `json:"name,omitempty"`
+	ID        string             `json:"id,omitempty"`
+	Start     time.Time          `json:"start"`
+	Stop      time.Time          `json:"stop"`
+	GoVersion string             `json:"go_version"`
+	Args      []string           `json:"args,omitempty"`
+	Archive   string             `json:"archive,omitempty"`
+	Profiles  []*manifestprofile `json:"profiles"`
+
+	mu sync.Mutex
+}
+
+// manifestprofile describes the output of one profile.
+type manifestprofile struct {
+	Name  string         `json:"name"`
+	Files []manifestfile `json:"files"`
+	Error string         `json:"error,omitempty"`
+}
+
+// manifestfile describes an output file.
+type manifestfile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// profile returns the manifest entry for method m, creating it if necessary.
+// Must be called with the lock held.
+func (mf *manifest) profile(m method) *manifestprofile {
+	for _, e := range mf.Profiles {
+		if e.Name == m.Name() {
+			return e
+		}
+	}
+	e := &manifestprofile{Name: m.Name(), Files: []manifestfile{}}
+	mf.Profiles = append(mf.Profiles, e)
+	return e
+}
+
+// started records that method m was started.
+func (mf *manifest) started(m method) {
+	if mf == nil {
+		return
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	mf.profile(m)
+}
+
+// error records an error from method m. Only the first error is recorded.
+func (mf *manifest) error(m method, err error) {
+	if mf == nil {
+		return
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if e := mf.profile(m); e.Error == "" {
+		e.Error = err.Error()
+	}
+}
+
+// file records an output file of method m.
+func (mf *manifest) file(m method, path string, size int64) {
+	if mf == nil {
+		return
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	e := mf.profile(m)
+	e.Files = append(e.Files, manifestfile{Path: path, Size: size})
+}
+
+// countwriter counts bytes written, and reports the count on close. The count
+// is only reported if all writes succeeded, so that a failed attempt at a write
+// that is then retried is not counted.
+type countwriter struct {
+	io.WriteCloser
+	n     int64
+	err   error
+	close func(n int64)
+}
+
+func (w *countwriter) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	w.n += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *countwriter) Close() error {
+	err := w.WriteCloser.Close()
+	if w.err == nil && err == nil {
+		w.close(w.n)
+	}
+	return err
+}
+
+// writemanifest writes the manifest to the underlying filesystem.
+func (p *Profile) writemanifest() (err error) {
+	p.manifest.Stop = p.clock()
+
+	f, err := p.fs.Create(p.path(p.manifestpath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errc := f.Close(); err == nil && errc != nil {
+			err = errc
+		}
+	}()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	return enc.Encode(p.manifest)
+}
+
+// newmanifest builds a manifest for a session started at start.
+func (p *Profile) newmanifest(start time.Time) *manifest {
+	mf := &manifest{
+		Name:      p.name,
+		ID:        p.id,
+		Start:     start,
+		GoVersion: runtime.Version(),
+		Args:      p.args(),
+		Profiles:  []*manifestprofile{},
+	}
+	if p.archivepath != "" {
+		mf.Archive = p.path(p.archivepath)
+	}
+	return mf
+}
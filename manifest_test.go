@@ -0,0 +1,135 @@
+package profile_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithManifest(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	profile.Start(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithTraceFile("missing/trace.out"),
+		profile.WithOutputDir(dir),
+		profile.WithManifest("manifest.json"),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	// Read the manifest.
+	b, err := ioutil.ReadFile("manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("manifest:\n%s", b)
+
+	var manifest struct {
+		GoVersion string `json:"go_version"`
+		Profiles  []struct {
+			Name  string `json:"name"`
+			Files []struct {
+				Path string `json:"path"`
+				Size int64  `json:"size"`
+			} `json:"files"`
+			Error string `json:"error"`
+		} `json:"profiles"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest.GoVersion != runtime.Version() {
+		t.Errorf("go version %q; expect %q", manifest.GoVersion, runtime.Version())
+	}
+
+	// Verify files are listed with correct sizes.
+	files := map[string]int64{}
+	errs := map[string]string{}
+	for _, p := range manifest.Profiles {
+		for _, f := range p.Files {
+			files[f.Path] = f.Size
+		}
+		errs[p.Name] = p.Error
+	}
+
+	for _, filename := range []string{"cpu.pprof", "mem.pprof"} {
+		path := filepath.Join(dir, filename)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, ok := files[path]; !ok || size != info.Size() {
+			t.Errorf("manifest size of %s is %d; expect %d", path, size, info.Size())
+		}
+	}
+	if len(files) != 2 {
+		t.Errorf("expected 2 files in manifest; got %d", len(files))
+	}
+
+	// Expect error to be recorded for the trace.
+	if errs["trace"] == "" {
+		t.Error("expected trace error in manifest")
+	}
+}
+
+func TestWithRecordArgs(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.MemProfile,
+		profile.WithRecordArgs(),
+		profile.WithArgsRedactor(func(arg string) string {
+			if strings.HasPrefix(arg, "-test.") {
+				return "REDACTED"
+			}
+			return arg
+		}),
+		profile.WithManifest("manifest.json"),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	// Determine expected arguments.
+	expect := []string{os.Args[0]}
+	for _, arg := range os.Args[1:] {
+		if strings.HasPrefix(arg, "-test.") {
+			arg = "REDACTED"
+		}
+		expect = append(expect, arg)
+	}
+
+	// Verify log.
+	t.Log(buf.String())
+	if line := fmt.Sprintf("args: %q", expect); !strings.Contains(buf.String(), line) {
+		t.Errorf("expected %q in output", line)
+	}
+
+	// Verify manifest.
+	b, err := ioutil.ReadFile("manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest struct {
+		Args []string `json:"args"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(manifest.Args, expect) {
+		t.Errorf("manifest args %q; expect %q", manifest.Args, expect)
+	}
+}
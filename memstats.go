@@ -0,0 +1,37 @@
+package profile
+
+import (
+	"runtime"
+	"time"
+)
+
+// WithMemStatsLog configures key memory statistics to be logged every
+// interval while profiling is running: the bytes of allocated heap objects,
+// the number of completed garbage collections, and the bytes obtained from the
+// operating system. For example, "memstats: heapalloc=4194304 numgc=12
+// sys=12582912". This gives a lightweight view of memory behavior over the
+// run, without a memory profile.
+func WithMemStatsLog(interval time.Duration) func(*Profile) {
+	return func(p *Profile) { p.memstatslog = interval }
+}
+
+// startmemstats starts logging memory statistics, if configured.
+func (p *Profile) startmemstats() {
+	if p.memstatslog <= 0 || p.dryrun {
+		return
+	}
+
+	p.memstats = poll(p.memstatslog, func() {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		p.info("memstats: heapalloc=%d numgc=%d sys=%d", stats.HeapAlloc, stats.NumGC, stats.Sys)
+	})
+}
+
+// stopmemstats stops logging memory statistics, if running.
+func (p *Profile) stopmemstats() {
+	if p.memstats != nil {
+		p.memstats.stop()
+		p.memstats = nil
+	}
+}
@@ -0,0 +1,49 @@
+package profile_test
+
+import (
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithMemStatsLog(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Log to a channel so we can wait for memory statistics.
+	lines := make(chan string, 64)
+	p := profile.Start(
+		profile.MemProfile,
+		profile.WithMemStatsLog(10*time.Millisecond),
+		profile.WithLogger(log.New(LineWriter(lines), "", 0)),
+	)
+
+	timeout := time.After(10 * time.Second)
+	for n := 0; n < 3; {
+		select {
+		case line := <-lines:
+			t.Log(line)
+			if strings.HasPrefix(line, "memstats: heapalloc=") {
+				n++
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for memory statistics")
+		}
+	}
+
+	p.Stop()
+
+	// Expect no memory statistics once stopped.
+	for len(lines) > 0 {
+		<-lines
+	}
+	time.Sleep(50 * time.Millisecond)
+	for len(lines) > 0 {
+		if line := <-lines; strings.HasPrefix(line, "memstats:") {
+			t.Fatalf("memory statistics logged after stop: %s", line)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package profile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	pprofile "github.com/google/pprof/profile"
+)
+
+// WithMergeInto configures the cpu profile to be merged into an accumulated
+// profile at path when profiling stops, creating it if it doesn't exist. This
+// aggregates profiles across repeated runs of a program into a single file. The
+// cpu profile is still written to its output file as usual. The accumulated
+// profile is read and written on the operating system filesystem. Relative
+// paths are resolved against the output directory, if configured, but not the
+// run directory of WithRunDir.
+func WithMergeInto(path string) func(*Profile) {
+	return func(p *Profile) { p.mergepath = path }
+}
+
+// mergeinto merges the encoded profile b into the accumulated profile.
+func (p *Profile) mergeinto(b []byte) (err error) {
+	path := p.basepath(p.mergepath)
+
+	prof, err := pprofile.Parse(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	srcs := []*pprofile.Profile{prof}
+
+	// Read the accumulated profile, if it exists.
+	existing, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		acc, err := pprofile.Parse(bytes.NewReader(existing))
+		if err != nil {
+			return fmt.Errorf("merging into %s: %w", path, err)
+		}
+		srcs = []*pprofile.Profile{acc, prof}
+	}
+
+	merged, err := pprofile.Merge(srcs)
+	if err != nil {
+		return fmt.Errorf("merging into %s: %w", path, err)
+	}
+
+	// Write to a temporary file and rename it into place, so the accumulated
+	// profile is never left partially written.
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name()) // best effort: ignore error since we already have one
+		}
+	}()
+
+	// Temporary files are created private. Make the profile readable, as
+	// os.Create would with the usual umask.
+	if err := f.Chmod(0o644); err != nil {
+		_ = f.Close() // best effort: ignore error since we already have one
+		return err
+	}
+	if err := merged.Write(f); err != nil {
+		_ = f.Close() // best effort: ignore error since we already have one
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
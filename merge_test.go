@@ -0,0 +1,94 @@
+package profile_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"testing"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithMergeInto(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	accumulated := filepath.Join(t.TempDir(), "merged.pprof")
+
+	// Run two sessions, with labelled busy work in each.
+	for _, run := range []string{"1", "2"} {
+		p := profile.Start(
+			profile.CPUProfile,
+			profile.WithMergeInto(accumulated),
+			profile.WithLogger(Logger(t)),
+		)
+		profile.Do(context.Background(), []string{"run", run}, func(context.Context) {
+			spin(300 * time.Millisecond)
+		})
+		p.Stop()
+	}
+
+	// Expect no temporary files to remain.
+	AssertDirContains(t, filepath.Dir(accumulated), []string{"merged.pprof"})
+
+	// Confirm the accumulated profile has samples from both runs.
+	f, err := os.Open(accumulated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	prof, err := pprofile.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs := map[string]bool{}
+	for _, s := range prof.Sample {
+		for _, run := range s.Label["run"] {
+			runs[run] = true
+		}
+	}
+	if !runs["1"] || !runs["2"] {
+		t.Fatalf("expected samples from both runs; got runs %v", runs)
+	}
+}
+
+func TestWithMergeIntoIncompatible(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Accumulate into an existing heap profile, which cannot be merged with the
+	// cpu profile.
+	accumulated := filepath.Join(t.TempDir(), "merged.pprof")
+	buf := new(bytes.Buffer)
+	if err := pprof.Lookup("heap").WriteTo(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(accumulated, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.WithMergeInto(accumulated),
+		profile.WithLogger(Logger(t)),
+	)
+	spin(50 * time.Millisecond)
+	p.Stop()
+
+	// Expect the accumulated profile to be untouched.
+	AssertDirContains(t, filepath.Dir(accumulated), []string{"merged.pprof"})
+	b, err := ioutil.ReadFile(accumulated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, buf.Bytes()) {
+		t.Fatal("accumulated profile modified")
+	}
+}
@@ -1,18 +1,24 @@
 package profile
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
-	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
+	"strings"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
 )
 
 // AllProfiles enables all profiling types. Running all profiles at once is
 // generally not a good idea, so it's recommended that this option is combined
-// with some configuration mechanism, via flags or otherwise.
+// with some configuration mechanism, via flags or otherwise. Samplers of
+// runtime statistics, such as SchedTraceProfile, are not included.
 func AllProfiles(p *Profile) {
 	p.Configure(
 		CPUProfile,
@@ -25,49 +31,192 @@ func AllProfiles(p *Profile) {
 	)
 }
 
+// WithOverheadBudget enables a curated set of profiles according to the
+// acceptable overhead, for use where it's unclear which profiles are safe to
+// run, such as in production. Levels are cumulative:
+//
+//   - "low": the cpu, memory and goroutine profiles, which sample at a low
+//     rate or are captured only at Stop.
+//   - "medium": additionally the thread creation profile, runtime/metrics
+//     sampling and garbage collection pause capture.
+//   - "high": additionally the block and mutex profiles, which record
+//     contention events, and the execution trace, which records every
+//     scheduling event. Together with the above, these are all the profiles
+//     enabled by AllProfiles.
+//
+// Unknown levels enable no profiles, and are reported as an error starting
+// profiling.
+func WithOverheadBudget(level string) func(*Profile) {
+	low := []func(*Profile){CPUProfile, MemProfile, GoroutineProfile}
+	medium := append(low, ThreadcreationProfile, MetricsProfile, GCTraceProfile)
+	high := append(medium, BlockProfile, MutexProfile, TraceProfile)
+	return func(p *Profile) {
+		switch level {
+		case "low":
+			p.Configure(low...)
+		case "medium":
+			p.Configure(medium...)
+		case "high":
+			p.Configure(high...)
+		default:
+			// Disable rather than fall back to the default cpu profile.
+			Disabled(p)
+			err := fmt.Errorf("overhead budget: unknown level %q: expected low, medium or high", level)
+			p.optionerrs = append(p.optionerrs, err)
+		}
+	}
+}
+
+// explainer is implemented by methods that can explain why they are disabled,
+// when the reason may not be obvious to the user.
+type explainer interface {
+	// disabledreason returns a description of why the method is disabled, or
+	// the empty string if there is nothing to explain.
+	disabledreason() string
+}
+
+// streamer is implemented by methods that may write to a different file than
+// the one configured, such as rotated or gated streaming profiles.
+type streamer interface {
+	// currentfile returns the output file currently being written, or the
+	// empty string if there is none. Safe to call while output is rotated in
+	// the background.
+	currentfile() string
+}
+
+// ratereason explains a rate-based method that is disabled by its rate,
+// despite an output file being configured.
+func ratereason(filename string, rate int) string {
+	if filename == "" || rate > 0 {
+		return ""
+	}
+	return fmt.Sprintf("output file %q configured but rate %d disables profiling", filename, rate)
+}
+
 type method interface {
 	Name() string
+	Filename() string
+	setfilename(filename string)
 	SetFlags(f *flag.FlagSet)
 	Enabled() bool
-	Start() error
-	Stop() error
+	Start(p *Profile) error
+	Stop(p *Profile) error
+}
+
+// Disabled adds a method that never profiles. Since a profiling session with no
+// methods defaults to cpu profiling, this allows a session to be explicitly
+// configured to do nothing.
+func Disabled(p *Profile) {
+	p.addmethod(noop{})
 }
 
+type noop struct{}
+
+func (noop) Name() string             { return "disabled" }
+func (noop) Filename() string         { return "" }
+func (noop) setfilename(string)       {}
+func (noop) SetFlags(f *flag.FlagSet) {}
+func (noop) Enabled() bool            { return false }
+func (noop) Start(*Profile) error     { return nil }
+func (noop) Stop(*Profile) error      { return nil }
+
 // CPUProfile enables cpu profiling.
 func CPUProfile(p *Profile) {
 	p.addmethod(&cpu{
-		filename: "cpu.pprof",
+		outfile: outfile{filename: "cpu.pprof", flag: "cpuprofile"},
 	})
 }
 
+// WithCPUProfileFile enables cpu profiling to the given file.
+func WithCPUProfileFile(filename string) func(*Profile) {
+	return withfile("cpu", CPUProfile, filename)
+}
+
 type cpu struct {
-	filename string
+	outfile
+	rate int
 
-	f io.WriteCloser
+	f       io.WriteCloser
+	buf     *bytes.Buffer
+	poller  *poller
+	window  int
+	rotator *rotator
 }
 
-func (cpu) Name() string { return "cpu" }
+func (*cpu) Name() string { return "cpu" }
+
+// cpurate is the sampling rate of cpu profiles written by the pprof package.
+const cpurate = 100
 
 func (c *cpu) SetFlags(f *flag.FlagSet) {
 	// Reference: https://github.com/golang/go/blob/303b194c6daf319f88e56d8ece56d924044f65a8/src/testing/testing.go#L292
 	//
 	//		cpuProfile = flag.String("test.cpuprofile", "", "write a cpu profile to `file`")
 	//
-	f.StringVar(&c.filename, "cpuprofile", "", "write a cpu profile to `file`")
+	c.fileflag(f, "write a cpu profile to `file`")
+	f.IntVar(&c.rate, "cpuprofilerate", 0, "set cpu profiling `rate` in Hz (only the default of 100 is supported)")
 }
 
 func (c *cpu) Enabled() bool { return c.filename != "" }
 
-func (c *cpu) Start() error {
+func (c *cpu) Start(p *Profile) error {
+	// The pprof package always profiles at its default rate, and setting the
+	// rate beforehand with runtime.SetCPUProfileRate is not supported. Fail
+	// rather than silently ignore the configured rate.
+	if c.rate != 0 && c.rate != cpurate {
+		return fmt.Errorf("unsupported rate %d Hz: pprof only supports the default of %d Hz", c.rate, cpurate)
+	}
+
+	// Record parallelism, which is essential context for interpreting the
+	// profile.
+	p.methodinfo(c, "%s profile: GOMAXPROCS=%d NumCPU=%d", c.Name(), runtime.GOMAXPROCS(0), runtime.NumCPU())
+
+	if p.gate != nil {
+		c.startgate(p)
+		return nil
+	}
+	if p.rotatebytes > 0 {
+		r, err := p.startrotation(c, rotateinterval, p.rotatebytes, pprof.StartCPUProfile, pprof.StopCPUProfile)
+		c.rotator = r
+		return err
+	}
+	if p.interval > 0 {
+		r, err := p.startrotation(c, p.interval, 0, pprof.StartCPUProfile, pprof.StopCPUProfile)
+		c.rotator = r
+		return err
+	}
+	return c.start(p, c.filename)
+}
+
+func (c *cpu) currentfile() string {
+	switch {
+	case c.poller != nil:
+		// Gated windows are logged as they open.
+		return ""
+	case c.rotator != nil:
+		return c.rotator.currentfile()
+	}
+	return c.filename
+}
+
+func (c *cpu) start(p *Profile, filename string) error {
 	// Open output file.
-	f, err := os.Create(c.filename)
+	f, err := p.create(c, filename)
 	if err != nil {
 		return err
 	}
 
+	// Retain a copy to merge, if configured.
+	var w io.Writer = f
+	if p.mergepath != "" {
+		c.buf = new(bytes.Buffer)
+		w = io.MultiWriter(f, c.buf)
+	}
+
 	// Start profile.
-	if err := pprof.StartCPUProfile(f); err != nil {
+	if err := pprof.StartCPUProfile(w); err != nil {
 		_ = f.Close() // best effort: ignore error since we already have one
+		c.buf = nil
 		return err
 	}
 
@@ -76,21 +225,60 @@ func (c *cpu) Start() error {
 	return nil
 }
 
-func (c *cpu) Stop() error {
+func (c *cpu) Stop(p *Profile) error {
+	if c.poller != nil {
+		return c.stopgate(p)
+	}
+	if c.rotator != nil {
+		err := c.rotator.stop()
+		c.rotator = nil
+		return err
+	}
+	return c.stop(p)
+}
+
+func (c *cpu) stop(p *Profile) error {
 	pprof.StopCPUProfile()
-	return c.f.Close()
+	err := c.f.Close()
+	c.f = nil
+
+	// Merge into accumulated profile.
+	if c.buf != nil {
+		if errm := p.mergeinto(c.buf.Bytes()); err == nil && errm != nil {
+			err = errm
+		}
+		c.buf = nil
+	}
+
+	return err
 }
 
 // MemProfile enables memory profiling.
 func MemProfile(p *Profile) {
 	p.addmethod(&mem{
-		filename: "mem.pprof",
+		outfile: outfile{filename: "mem.pprof", flag: "memprofile"},
 	})
 }
 
+// WithMemProfileFile enables memory profiling to the given file.
+func WithMemProfileFile(filename string) func(*Profile) {
+	return withfile("mem", MemProfile, filename)
+}
+
+// WithMemProfileNoGC configures the memory profile to be written without first
+// forcing a garbage collection. By default a collection is forced so the
+// profile reflects all allocations up to that point, at the cost of a
+// stop-the-world pause which may be significant on large heaps. Without it the
+// profile is accurate only as of the most recently completed collection. Also
+// applies to the other memory profiles, such as DeltaMemProfile.
+func WithMemProfileNoGC() func(*Profile) {
+	return func(p *Profile) { p.memnogc = true }
+}
+
 type mem struct {
-	filename string
-	rate     int
+	outfile
+	rate  int
+	debug int
 
 	prevrate int
 }
@@ -103,13 +291,15 @@ func (m *mem) SetFlags(f *flag.FlagSet) {
 	//		memProfile = flag.String("test.memprofile", "", "write an allocation profile to `file`")
 	//		memProfileRate = flag.Int("test.memprofilerate", 0, "set memory allocation profiling `rate` (see runtime.MemProfileRate)")
 	//
-	f.StringVar(&m.filename, "memprofile", "", "write an allocation profile to `file`")
+	m.fileflag(f, "write an allocation profile to `file`")
 	f.IntVar(&m.rate, "memprofilerate", 0, "set memory allocation profiling `rate` (see runtime.MemProfileRate)")
+	f.IntVar(&m.debug, "memprofiledebug", 0,
+		"write the allocation profile in legacy text format with debug `level` (see pprof.Profile.WriteTo)")
 }
 
 func (m *mem) Enabled() bool { return m.filename != "" }
 
-func (m *mem) Start() error {
+func (m *mem) Start(*Profile) error {
 	m.prevrate = runtime.MemProfileRate
 	if m.rate > 0 {
 		runtime.MemProfileRate = m.rate
@@ -117,12 +307,12 @@ func (m *mem) Start() error {
 	return nil
 }
 
-func (m *mem) Stop() error {
+func (m *mem) Stop(p *Profile) error {
 	// Materialize all statistics.
-	runtime.GC()
+	p.memgc()
 
 	// Write to file.
-	err := writeprofile("allocs", m.filename)
+	err := p.writeprofile(m, "allocs", m.filename, m.debug)
 
 	// Restore profile rate.
 	runtime.MemProfileRate = m.prevrate
@@ -130,56 +320,320 @@ func (m *mem) Stop() error {
 	return err
 }
 
+// WithMinAllocSize configures the memory profiles to include only allocation
+// sites whose average allocated object size is at least the given number of
+// bytes. This focuses the profile on large allocations, removing noise from
+// small frequent ones. Does not apply to profiles written in legacy text
+// format.
+func WithMinAllocSize(bytes int64) func(*Profile) {
+	return func(p *Profile) { p.minallocsize = bytes }
+}
+
+// filterallocs removes samples from the memory profile prof with average
+// allocation size below the configured minimum, returning the filtered
+// profile.
+func (p *Profile) filterallocs(prof *pprofile.Profile) *pprofile.Profile {
+	objects, space := sampleindex(prof, "alloc_objects"), sampleindex(prof, "alloc_space")
+	if objects < 0 || space < 0 {
+		return prof
+	}
+	samples := prof.Sample[:0]
+	for _, s := range prof.Sample {
+		if n := s.Value[objects]; n != 0 && s.Value[space]/n >= p.minallocsize {
+			samples = append(samples, s)
+		}
+	}
+	prof.Sample = samples
+
+	// Remove locations, functions and mappings no longer referenced.
+	return prof.Compact()
+}
+
+// memgc forces a garbage collection to materialize memory profile statistics,
+// unless disabled by WithMemProfileNoGC.
+func (p *Profile) memgc() {
+	if !p.memnogc {
+		runtime.GC()
+	}
+}
+
+// FullMemProfile enables memory profiling to both the allocs and heap
+// profiles, written to allocs.pprof and heap.pprof. The profiles share the
+// same runtime sampling, so are written after a single garbage collection
+// rather than one each. The allocs profile defaults to reporting allocated
+// space and the heap profile to in-use space. The heap profile filename is
+// derived from the allocs profile filename by replacing "allocs" with "heap",
+// for example run1.allocs.pprof and run1.heap.pprof. If the allocs filename
+// does not contain "allocs", ".heap" is inserted before its extension.
+func FullMemProfile(p *Profile) {
+	p.addmethod(&fullmem{
+		outfile: outfile{filename: "allocs.pprof", flag: "fullmemprofile"},
+	})
+}
+
+// WithFullMemProfileFile enables full memory profiling, with the allocs profile
+// written to the given file.
+func WithFullMemProfileFile(filename string) func(*Profile) {
+	return withfile("fullmem", FullMemProfile, filename)
+}
+
+type fullmem struct {
+	outfile
+	rate int
+
+	prevrate int
+}
+
+func (fullmem) Name() string { return "fullmem" }
+
+func (m *fullmem) SetFlags(f *flag.FlagSet) {
+	m.fileflag(f, "write allocs profile to `file`, and heap profile alongside")
+	f.IntVar(&m.rate, "fullmemprofilerate", 0, "set memory allocation profiling `rate` (see runtime.MemProfileRate)")
+}
+
+func (m *fullmem) Enabled() bool { return m.filename != "" }
+
+func (m *fullmem) Start(*Profile) error {
+	m.prevrate = runtime.MemProfileRate
+	if m.rate > 0 {
+		runtime.MemProfileRate = m.rate
+	}
+	return nil
+}
+
+func (m *fullmem) Stop(p *Profile) error {
+	// Materialize all statistics, once for both profiles.
+	p.memgc()
+
+	// Write to files.
+	err := p.writeprofile(m, "allocs", m.filename, 0)
+	if errh := p.writeprofile(m, "heap", heapfilename(m.filename), 0); err == nil {
+		err = errh
+	}
+
+	// Restore profile rate.
+	runtime.MemProfileRate = m.prevrate
+
+	return err
+}
+
+// heapfilename returns the heap profile filename accompanying the allocs
+// profile filename.
+func heapfilename(filename string) string {
+	dir, base := filepath.Split(filename)
+	if i := strings.LastIndex(base, "allocs"); i >= 0 {
+		return dir + base[:i] + "heap" + base[i+len("allocs"):]
+	}
+	ext := filepath.Ext(base)
+	return dir + strings.TrimSuffix(base, ext) + ".heap" + ext
+}
+
+// DeltaMemProfile enables memory profiling of allocations made while profiling
+// is running. Whereas MemProfile reports cumulative totals since the program
+// started, this captures the heap profile at Start and writes the difference
+// between it and the heap profile at Stop.
+func DeltaMemProfile(p *Profile) {
+	p.addmethod(&deltamem{
+		outfile: outfile{filename: "deltamem.pprof", flag: "deltamemprofile"},
+	})
+}
+
+// WithDeltaMemProfileFile enables delta memory profiling to the given file.
+func WithDeltaMemProfileFile(filename string) func(*Profile) {
+	return withfile("deltamem", DeltaMemProfile, filename)
+}
+
+type deltamem struct {
+	outfile
+	rate int
+
+	prevrate int
+	base     *pprofile.Profile
+}
+
+func (deltamem) Name() string { return "deltamem" }
+
+func (d *deltamem) SetFlags(f *flag.FlagSet) {
+	d.fileflag(f, "write an allocation profile of the profiling period to `file`")
+	f.IntVar(&d.rate, "deltamemprofilerate", 0, "set memory allocation profiling `rate` (see runtime.MemProfileRate)")
+}
+
+func (d *deltamem) Enabled() bool { return d.filename != "" }
+
+func (d *deltamem) Start(p *Profile) error {
+	d.prevrate = runtime.MemProfileRate
+	if d.rate > 0 {
+		runtime.MemProfileRate = d.rate
+	}
+
+	// Materialize statistics and capture the base profile.
+	p.memgc()
+	base, err := captureprofile("allocs")
+	if err != nil {
+		runtime.MemProfileRate = d.prevrate
+		return err
+	}
+	d.base = base
+
+	return nil
+}
+
+func (d *deltamem) Stop(p *Profile) error {
+	// Materialize all statistics.
+	p.memgc()
+
+	// Capture, then restore profile rate.
+	cur, err := captureprofile("allocs")
+	runtime.MemProfileRate = d.prevrate
+	if err != nil {
+		return err
+	}
+
+	// Subtract the base profile.
+	delta, err := diffprofiles(d.base, cur)
+	if err != nil {
+		return err
+	}
+	d.base = nil
+	if p.minallocsize > 0 {
+		delta = p.filterallocs(delta)
+	}
+	if p.deterministic {
+		delta = canonicalize(delta)
+	}
+
+	// Write to file, retrying on transient errors.
+	return p.retrywrite(d, d.filename, delta.Write)
+}
+
 // GoroutineProfile enables goroutine profiling.
 func GoroutineProfile(p *Profile) {
 	p.addmethod(&lookup{
-		name:     "goroutine",
-		long:     "running goroutine",
-		filename: "goroutine.pprof",
+		name:    "goroutine",
+		long:    "running goroutine",
+		outfile: outfile{filename: "goroutine.pprof", flag: "goroutineprofile"},
 	})
 }
 
+// WithGoroutineProfileFile enables goroutine profiling to the given file.
+func WithGoroutineProfileFile(filename string) func(*Profile) {
+	return withfile("goroutine", GoroutineProfile, filename)
+}
+
 // ThreadcreationProfile enables thread creation profiling.
 func ThreadcreationProfile(p *Profile) {
 	p.addmethod(&lookup{
-		name:     "threadcreate",
-		long:     "thread creation",
-		filename: "threadcreate.pprof",
+		name:    "threadcreate",
+		long:    "thread creation",
+		outfile: outfile{filename: "threadcreate.pprof", flag: "threadcreateprofile"},
 	})
 }
 
+// WithThreadcreationProfileFile enables thread creation profiling to the given
+// file.
+func WithThreadcreationProfileFile(filename string) func(*Profile) {
+	return withfile("threadcreate", ThreadcreationProfile, filename)
+}
+
 type lookup struct {
 	name string
 	long string
 
-	filename string
+	outfile
 }
 
 func (l *lookup) Name() string { return l.name }
 
 func (l *lookup) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&l.filename, l.name+"profile", "", "write a "+l.long+" profile to `file`")
+	l.fileflag(f, "write a "+l.long+" profile to `file`")
 }
 
 func (l *lookup) Enabled() bool { return l.filename != "" }
 
-func (l *lookup) Start() error { return nil }
+func (l *lookup) Start(*Profile) error { return nil }
+
+func (l *lookup) Stop(p *Profile) error {
+	return p.writeprofile(l, l.name, l.filename, 0)
+}
+
+// FullDumpProfile enables a dump of the stacks of all goroutines at Stop, in
+// the format of an unrecovered panic. Unlike the goroutine profile with debug
+// level 2, which is limited to 64MB, the dump is never truncated. The dump is
+// written as text. Goroutines internal to the runtime are not included: set
+// GOTRACEBACK=crash and send SIGQUIT for a complete crash dump.
+func FullDumpProfile(p *Profile) {
+	p.addmethod(&fulldump{
+		outfile: outfile{filename: "fulldump.txt", flag: "fulldump"},
+	})
+}
+
+// WithFullDumpProfileFile enables a full goroutine stack dump to the given
+// file.
+func WithFullDumpProfileFile(filename string) func(*Profile) {
+	return withfile("fulldump", FullDumpProfile, filename)
+}
+
+type fulldump struct {
+	outfile
+}
+
+func (*fulldump) Name() string { return "fulldump" }
+
+func (d *fulldump) SetFlags(f *flag.FlagSet) {
+	d.fileflag(f, "write a full dump of all goroutine stacks to `file`")
+}
+
+func (d *fulldump) Enabled() bool { return d.filename != "" }
+
+func (d *fulldump) Start(*Profile) error { return nil }
 
-func (l *lookup) Stop() error {
-	return writeprofile(l.name, l.filename)
+func (d *fulldump) Stop(p *Profile) error {
+	return d.snapshot(p, d.filename)
 }
 
-// BlockProfile enables block (contention) profiling.
+func (d *fulldump) snapshot(p *Profile, filename string) error {
+	return p.writefile(d, filename, func(w io.Writer) error {
+		_, err := w.Write(allstacks())
+		return err
+	})
+}
+
+// allstacks returns the stacks of all goroutines, growing the buffer until
+// the dump fits.
+func allstacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// BlockProfile enables block (contention) profiling. The block profile rate is
+// restored when profiling stops. Since the runtime provides no way to query
+// the rate, only rates set by this package can be restored: otherwise block
+// profiling is disabled.
 func BlockProfile(p *Profile) {
 	p.addmethod(&block{
-		filename: "block.pprof",
-		rate:     1,
+		outfile: outfile{filename: "block.pprof", flag: "blockprofile"},
+		rate:    1,
 	})
 }
 
+// WithBlockProfileFile enables block profiling to the given file.
+func WithBlockProfileFile(filename string) func(*Profile) {
+	return withfile("block", BlockProfile, filename)
+}
+
 type block struct {
-	filename string
-	rate     int
+	outfile
+	rate   int
+	period time.Duration
+	debug  int
+
+	prevrate int
 }
 
 func (block) Name() string { return "block" }
@@ -190,38 +644,63 @@ func (b *block) SetFlags(f *flag.FlagSet) {
 	//		blockProfile = flag.String("test.blockprofile", "", "write a goroutine blocking profile to `file`")
 	//		blockProfileRate = flag.Int("test.blockprofilerate", 1, "set blocking profile `rate` (see runtime.SetBlockProfileRate)")
 	//
-	f.StringVar(&b.filename, "blockprofile", "", "write a goroutine blocking profile to `file`")
+	b.fileflag(f, "write a goroutine blocking profile to `file`")
 	f.IntVar(&b.rate, "blockprofilerate", 1, "set blocking profile `rate` (see runtime.SetBlockProfileRate)")
+	f.DurationVar(&b.period, "blockprofileperiod", 0,
+		"sample an average of one blocking event per `period` spent blocked, overriding -blockprofilerate")
+	f.IntVar(&b.debug, "blockprofiledebug", 0,
+		"write the blocking profile in legacy text format with debug `level` (see pprof.Profile.WriteTo)")
 }
 
-func (b *block) Enabled() bool { return b.filename != "" && b.rate > 0 }
+// effectiverate returns the block profile rate, in nanoseconds. A period, if
+// configured, takes precedence over the rate.
+func (b *block) effectiverate() int {
+	if b.period > 0 {
+		return int(b.period.Nanoseconds())
+	}
+	return b.rate
+}
+
+func (b *block) Enabled() bool { return b.filename != "" && b.effectiverate() > 0 }
 
-func (b *block) Start() error {
-	runtime.SetBlockProfileRate(b.rate)
+func (b *block) disabledreason() string { return ratereason(b.filename, b.effectiverate()) }
+
+func (b *block) Start(*Profile) error {
+	b.prevrate = blockrate()
+	setblockrate(b.effectiverate())
 	return nil
 }
 
-func (b *block) Stop() error {
+func (b *block) Stop(p *Profile) error {
 	// Write to file.
-	err := writeprofile("block", b.filename)
+	err := p.writeprofile(b, "block", b.filename, b.debug)
 
-	// Disable block profiling.
-	runtime.SetBlockProfileRate(0)
+	// Restore block profile rate.
+	setblockrate(b.prevrate)
 
 	return err
 }
 
-// MutexProfile enables mutex profiling.
+// MutexProfile enables mutex profiling. The mutex profile fraction is restored
+// to its previous value when profiling stops.
 func MutexProfile(p *Profile) {
 	p.addmethod(&mutex{
-		filename: "mutex.pprof",
-		rate:     1,
+		outfile: outfile{filename: "mutex.pprof", flag: "mutexprofile"},
+		rate:    1,
 	})
 }
 
+// WithMutexProfileFile enables mutex profiling to the given file.
+func WithMutexProfileFile(filename string) func(*Profile) {
+	return withfile("mutex", MutexProfile, filename)
+}
+
 type mutex struct {
-	filename string
-	rate     int
+	outfile
+	rate  int
+	debug int
+
+	prevrate int
 }
 
 func (mutex) Name() string { return "mutex" }
@@ -232,23 +711,27 @@ func (m *mutex) SetFlags(f *flag.FlagSet) {
 	//		mutexProfile = flag.String("test.mutexprofile", "", "write a mutex contention profile to the named file after execution")
 	//		mutexProfileFraction = flag.Int("test.mutexprofilefraction", 1, "if >= 0, calls runtime.SetMutexProfileFraction()")
 	//
-	f.StringVar(&m.filename, "mutexprofile", "", "write a mutex contention profile to the named file after execution")
+	m.fileflag(f, "write a mutex contention profile to the named file after execution")
 	f.IntVar(&m.rate, "mutexprofilefraction", 1, "if >= 0, calls runtime.SetMutexProfileFraction()")
+	f.IntVar(&m.debug, "mutexprofiledebug", 0,
+		"write the mutex profile in legacy text format with debug `level` (see pprof.Profile.WriteTo)")
 }
 
 func (m *mutex) Enabled() bool { return m.filename != "" && m.rate > 0 }
 
-func (m *mutex) Start() error {
-	runtime.SetMutexProfileFraction(m.rate)
+func (m *mutex) disabledreason() string { return ratereason(m.filename, m.rate) }
+
+func (m *mutex) Start(*Profile) error {
+	m.prevrate = runtime.SetMutexProfileFraction(m.rate)
 	return nil
 }
 
-func (m *mutex) Stop() error {
+func (m *mutex) Stop(p *Profile) error {
 	// Write to file.
-	err := writeprofile("mutex", m.filename)
+	err := p.writeprofile(m, "mutex", m.filename, m.debug)
 
-	// Disable mutex profiling.
-	runtime.SetMutexProfileFraction(0)
+	// Restore mutex profile fraction.
+	runtime.SetMutexProfileFraction(m.prevrate)
 
 	return err
 }
@@ -256,69 +739,206 @@ func (m *mutex) Stop() error {
 // TraceProfile enables execution tracing.
 func TraceProfile(p *Profile) {
 	p.addmethod(&tracer{
-		filename: "trace.out",
+		outfile: outfile{filename: "trace.out", flag: "trace"},
 	})
 }
 
+// WithTraceFile enables execution tracing to the given file.
+func WithTraceFile(filename string) func(*Profile) {
+	return withfile("trace", TraceProfile, filename)
+}
+
+// WithTraceSplit configures the execution trace to be split into segments of
+// duration d, each written to a separate numbered file. For example, with the
+// default filename segments are written to trace-0001.out, trace-0002.out and
+// so on. Each segment is a complete trace, so can be analyzed independently.
+// Old segments may be pruned with WithRotation, which takes precedence if it
+// configures a size limit.
+func WithTraceSplit(d time.Duration) func(*Profile) {
+	return func(p *Profile) { p.tracesplit = d }
+}
+
+// WithTraceConverter configures a function to be called with the path of the
+// execution trace after it has been written and closed. This allows the trace
+// to be post-processed, for example converted into a format supported by other
+// trace viewers. The converter is not called for traces written to an archive.
+func WithTraceConverter(convert func(path string) error) func(*Profile) {
+	return func(p *Profile) { p.traceconverter = convert }
+}
+
 type tracer struct {
-	filename string
+	outfile
 
-	f io.WriteCloser
+	f       io.WriteCloser
+	current string
+	segment int
+	rotator *rotator
 }
 
-func (tracer) Name() string { return "trace" }
+func (*tracer) Name() string { return "trace" }
 
 func (t *tracer) SetFlags(f *flag.FlagSet) {
 	// Reference: https://github.com/golang/go/blob/303b194c6daf319f88e56d8ece56d924044f65a8/src/testing/testing.go#L298
 	//
 	//		traceFile = flag.String("test.trace", "", "write an execution trace to `file`")
 	//
-	f.StringVar(&t.filename, "trace", "", "write an execution trace to `file`")
+	t.fileflag(f, "write an execution trace to `file`")
 }
 
 func (t *tracer) Enabled() bool { return t.filename != "" }
 
-func (t *tracer) Start() error {
+func (t *tracer) Start(p *Profile) error {
+	if p.rotatebytes > 0 {
+		r, err := p.startrotation(t, rotateinterval, p.rotatebytes, trace.Start, trace.Stop)
+		t.rotator = r
+		return err
+	}
+	split := p.tracesplit
+	if split == 0 {
+		split = p.interval
+	}
+	if split > 0 {
+		r, err := p.startrotation(t, split, 0, trace.Start, trace.Stop)
+		t.rotator = r
+		return err
+	}
+
+	t.segment = 1
+	return t.start(p, t.filename)
+}
+
+func (t *tracer) currentfile() string {
+	if t.rotator != nil {
+		return t.rotator.currentfile()
+	}
+	return t.current
+}
+
+func (t *tracer) start(p *Profile, filename string) error {
 	// Open output file.
-	f, err := os.Create(t.filename)
+	f, err := p.create(t, filename)
 	if err != nil {
 		return err
 	}
 
-	// Start trace.
-	if err := trace.Start(f); err != nil {
+	// Start trace, stopping at the size limit if configured.
+	w, started := p.limittrace(t, f)
+	defer started()
+	if err := trace.Start(w); err != nil {
 		_ = f.Close() // best effort: ignore error since we already have one
 		return err
 	}
 
 	t.f = f
+	t.current = filename
 
 	return nil
 }
 
-func (t *tracer) Stop() error {
+func (t *tracer) Stop(p *Profile) error {
+	if t.rotator != nil {
+		err := t.rotator.stop()
+		t.rotator = nil
+		return err
+	}
+
+	// Nothing to do if paused.
+	if t.f == nil {
+		return nil
+	}
+
+	return t.stop(p)
+}
+
+func (t *tracer) stop(p *Profile) error {
 	trace.Stop()
-	return t.f.Close()
+	err := t.f.Close()
+	t.f = nil
+	if err != nil {
+		return err
+	}
+
+	// Post-process, if configured.
+	if p.traceconverter == nil {
+		return nil
+	}
+	if p.archive != nil {
+		p.log("%s profile: skipping converter for archived trace", t.Name())
+		return nil
+	}
+	if err := p.traceconverter(p.methodpath(t, t.current)); err != nil {
+		return fmt.Errorf("converting: %w", err)
+	}
+
+	return nil
 }
 
-func writeprofile(name, filename string) (err error) {
+// writeprofile writes the named profile to filename, an output of method m.
+// The debug parameter is passed to WriteTo: zero selects the protocol buffer
+// format, and nonzero values select legacy text formats.
+func (p *Profile) writeprofile(m method, name, filename string, debug int) error {
 	// Lookup profile.
-	p := pprof.Lookup(name)
-	if p == nil {
+	prof := pprof.Lookup(name)
+	if prof == nil {
 		return fmt.Errorf("unknown profile %q", name)
 	}
 
-	// Open file.
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
+	// Write, retrying on transient errors.
+	write := func(w io.Writer) error {
+		return prof.WriteTo(w, debug)
 	}
-	defer func() {
-		if errc := f.Close(); err == nil && errc != nil {
-			err = errc
+	if p.minallocsize > 0 && debug == 0 && (name == "allocs" || name == "heap") {
+		write = rewrite(write, p.filterallocs)
+	}
+	if p.deterministic && debug == 0 {
+		write = rewrite(write, canonicalize)
+	}
+	return p.retrywrite(m, filename, write)
+}
+
+// retrywrite writes filename, an output of method m, with the write function,
+// retrying on transient errors as configured by WithWriteRetries.
+func (p *Profile) retrywrite(m method, filename string, write func(w io.Writer) error) error {
+	backoff := writebackoff
+	for retry := 0; ; retry++ {
+		err := p.writefile(m, filename, write)
+		if err == nil || retry >= p.writeretries || !transient(err) {
+			return err
 		}
-	}()
+		p.debug("error writing %s: %v: retrying in %v", filename, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// diffprofiles returns the difference between profiles from and to, captured
+// at different times. Neither profile is modified.
+func diffprofiles(from, to *pprofile.Profile) (*pprofile.Profile, error) {
+	base, err := pprofile.Merge([]*pprofile.Profile{from})
+	if err != nil {
+		return nil, err
+	}
+	base.Scale(-1)
+	diff, err := pprofile.Merge([]*pprofile.Profile{to, base})
+	if err != nil {
+		return nil, err
+	}
+	diff.TimeNanos = from.TimeNanos
+	diff.DurationNanos = to.TimeNanos - from.TimeNanos
+	return diff, nil
+}
+
+// captureprofile captures the named profile in memory.
+func captureprofile(name string) (*pprofile.Profile, error) {
+	prof := pprof.Lookup(name)
+	if prof == nil {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := prof.WriteTo(buf, 0); err != nil {
+		return nil, err
+	}
 
-	// Write.
-	return p.WriteTo(f, 0)
+	return pprofile.Parse(buf)
 }
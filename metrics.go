@@ -0,0 +1,350 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchedTraceProfile enables periodic capture of scheduler and garbage collector
+// statistics, in the spirit of GODEBUG=schedtrace=X,gctrace=1.
+//
+// The runtime only reads the GODEBUG schedtrace and gctrace settings at program
+// startup, so they cannot be enabled by this package. Instead, statistics are
+// sampled from runtime/metrics at the configured interval and written to the
+// output file one line per sample, including one at Start and one at Stop.
+// The output is therefore coarser than the runtime's own trace: individual GC
+// cycles between samples are only visible as a change in the cycle count. Set
+// GODEBUG when launching the program if the runtime's native output is
+// required. Not enabled by AllProfiles.
+func SchedTraceProfile(p *Profile) {
+	p.addmethod(&schedtrace{
+		outfile:  outfile{filename: "schedtrace.out", flag: "schedtrace"},
+		interval: time.Second,
+	})
+}
+
+// WithSchedTraceFile enables scheduler statistics capture to the given file.
+func WithSchedTraceFile(filename string) func(*Profile) {
+	return withfile("schedtrace", SchedTraceProfile, filename)
+}
+
+type schedtrace struct {
+	outfile
+	interval time.Duration
+
+	f       io.WriteCloser
+	now     func() time.Time
+	start   time.Time
+	samples []metrics.Sample
+	poller  *poller
+	err     error
+}
+
+// schedtracemetrics are the metrics sampled by the schedtrace method, along
+// with the keys they are reported under.
+var schedtracemetrics = []struct {
+	key  string
+	name string
+}{
+	{"gomaxprocs", "/sched/gomaxprocs:threads"},
+	{"goroutines", "/sched/goroutines:goroutines"},
+	{"gc", "/gc/cycles/total:gc-cycles"},
+	{"heapgoal", "/gc/heap/goal:bytes"},
+	{"heapobjects", "/memory/classes/heap/objects:bytes"},
+}
+
+func (*schedtrace) Name() string { return "schedtrace" }
+
+func (s *schedtrace) SetFlags(f *flag.FlagSet) {
+	s.fileflag(f, "write scheduler and garbage collector statistics to `file`")
+	f.DurationVar(&s.interval, "schedtraceinterval", time.Second, "sample scheduler statistics every `interval`")
+}
+
+func (s *schedtrace) Enabled() bool { return s.filename != "" }
+
+func (s *schedtrace) Start(p *Profile) error {
+	if s.interval <= 0 {
+		return errors.New("sample interval must be positive")
+	}
+
+	// Open output file.
+	f, err := p.create(s, s.filename)
+	if err != nil {
+		return err
+	}
+	s.f = f
+
+	// Start sampling.
+	s.samples = make([]metrics.Sample, len(schedtracemetrics))
+	for i, m := range schedtracemetrics {
+		s.samples[i].Name = m.name
+	}
+	s.now = p.clock
+	s.start = s.now()
+	s.err = nil
+	s.sample()
+	s.poller = poll(s.interval, s.sample)
+
+	return nil
+}
+
+func (s *schedtrace) sample() {
+	if s.err != nil {
+		return
+	}
+
+	metrics.Read(s.samples)
+
+	line := fmt.Sprintf("SCHED %dms:", s.now().Sub(s.start).Milliseconds())
+	for i, sample := range s.samples {
+		if sample.Value.Kind() != metrics.KindUint64 {
+			continue
+		}
+		line += fmt.Sprintf(" %s=%d", schedtracemetrics[i].key, sample.Value.Uint64())
+	}
+
+	_, s.err = fmt.Fprintln(s.f, line)
+}
+
+func (s *schedtrace) Stop(*Profile) error {
+	s.poller.stop()
+	s.sample()
+	err := s.err
+	if errc := s.f.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// MetricsProfile enables periodic sampling of runtime/metrics. Samples are
+// written as newline-delimited JSON, one object per sample, including one at
+// Start and one at Stop. By default all supported scalar metrics are sampled;
+// histogram metrics are not supported. Not enabled by AllProfiles.
+func MetricsProfile(p *Profile) {
+	p.addmethod(&metricsampler{
+		outfile:  outfile{filename: "metrics.jsonl", flag: "metricsprofile"},
+		interval: time.Second,
+	})
+}
+
+// WithMetricsProfileFile enables runtime metrics sampling to the given file.
+func WithMetricsProfileFile(filename string) func(*Profile) {
+	return withfile("metrics", MetricsProfile, filename)
+}
+
+type metricsampler struct {
+	outfile
+	interval time.Duration
+	names    string
+
+	f       io.WriteCloser
+	now     func() time.Time
+	enc     *json.Encoder
+	samples []metrics.Sample
+	poller  *poller
+	err     error
+}
+
+// metricsample is the JSON representation of a sample of runtime metrics.
+type metricsample struct {
+	Time    time.Time              `json:"time"`
+	Metrics map[string]interface{} `json:"metrics"`
+}
+
+func (*metricsampler) Name() string { return "metrics" }
+
+func (m *metricsampler) SetFlags(f *flag.FlagSet) {
+	m.fileflag(f, "write runtime metrics samples to `file`")
+	f.DurationVar(&m.interval, "metricsinterval", time.Second, "sample runtime metrics every `interval`")
+	f.StringVar(&m.names, "metricsnames", "", "comma-separated `list` of runtime metrics to sample (default all)")
+}
+
+func (m *metricsampler) Enabled() bool { return m.filename != "" }
+
+func (m *metricsampler) Start(p *Profile) error {
+	if m.interval <= 0 {
+		return errors.New("sample interval must be positive")
+	}
+
+	// Determine metrics to sample.
+	samples, err := scalarsamples(m.names)
+	if err != nil {
+		return err
+	}
+
+	// Open output file.
+	f, err := p.create(m, m.filename)
+	if err != nil {
+		return err
+	}
+	m.f = f
+	m.enc = json.NewEncoder(f)
+
+	// Start sampling.
+	m.samples = samples
+	m.now = p.clock
+	m.err = nil
+	m.sample()
+	m.poller = poll(m.interval, m.sample)
+
+	return nil
+}
+
+func (m *metricsampler) sample() {
+	if m.err != nil {
+		return
+	}
+
+	metrics.Read(m.samples)
+
+	s := metricsample{
+		Time:    m.now(),
+		Metrics: make(map[string]interface{}, len(m.samples)),
+	}
+	for _, sample := range m.samples {
+		switch sample.Value.Kind() {
+		case metrics.KindUint64:
+			s.Metrics[sample.Name] = sample.Value.Uint64()
+		case metrics.KindFloat64:
+			s.Metrics[sample.Name] = sample.Value.Float64()
+		case metrics.KindFloat64Histogram, metrics.KindBad:
+		}
+	}
+
+	m.err = m.enc.Encode(s)
+}
+
+func (m *metricsampler) Stop(*Profile) error {
+	m.poller.stop()
+	m.sample()
+	err := m.err
+	if errc := m.f.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// scalarsamples builds samples for the comma-separated list of metric names,
+// or all supported scalar metrics if the list is empty.
+func scalarsamples(list string) ([]metrics.Sample, error) {
+	// Index supported scalar metrics.
+	var all []string
+	scalar := map[string]bool{}
+	for _, d := range metrics.All() {
+		if d.Kind == metrics.KindUint64 || d.Kind == metrics.KindFloat64 {
+			all = append(all, d.Name)
+			scalar[d.Name] = true
+		}
+	}
+
+	// Select requested metrics.
+	names := all
+	if list != "" {
+		names = strings.Split(list, ",")
+	}
+
+	samples := make([]metrics.Sample, 0, len(names))
+	for _, name := range names {
+		if !scalar[name] {
+			return nil, fmt.Errorf("unsupported metric %q", name)
+		}
+		samples = append(samples, metrics.Sample{Name: name})
+	}
+
+	return samples, nil
+}
+
+// GCTraceProfile enables capture of garbage collector stop-the-world pause
+// times. At Stop a histogram of pauses that occurred while profiling is written
+// in CSV format, with columns for the lower and upper bounds of each bucket in
+// seconds and the number of pauses. Empty buckets are omitted. Not enabled by
+// AllProfiles.
+func GCTraceProfile(p *Profile) {
+	p.addmethod(&gctrace{
+		outfile: outfile{filename: "gctrace.csv", flag: "gctraceprofile"},
+	})
+}
+
+// WithGCTraceFile enables capture of garbage collector pause times to the given
+// file.
+func WithGCTraceFile(filename string) func(*Profile) {
+	return withfile("gctrace", GCTraceProfile, filename)
+}
+
+type gctrace struct {
+	outfile
+
+	base *metrics.Float64Histogram
+}
+
+// gcpausemetrics are the names of the runtime metric for GC pause times, in
+// order of preference.
+var gcpausemetrics = []string{
+	"/sched/pauses/total/gc:seconds",
+	"/gc/pauses:seconds",
+}
+
+func (*gctrace) Name() string { return "gctrace" }
+
+func (g *gctrace) SetFlags(f *flag.FlagSet) {
+	g.fileflag(f, "write a histogram of garbage collector pause times to `file`")
+}
+
+func (g *gctrace) Enabled() bool { return g.filename != "" }
+
+func (g *gctrace) Start(*Profile) error {
+	h, err := gcpauses()
+	if err != nil {
+		return err
+	}
+	g.base = h
+	return nil
+}
+
+func (g *gctrace) Stop(p *Profile) error {
+	h, err := gcpauses()
+	if err != nil {
+		return err
+	}
+
+	// Subtract counts at start.
+	for i := range h.Counts {
+		h.Counts[i] -= g.base.Counts[i]
+	}
+
+	return p.writefile(g, g.filename, func(w io.Writer) error {
+		if _, err := fmt.Fprintln(w, "lower_seconds,upper_seconds,count"); err != nil {
+			return err
+		}
+		for i, n := range h.Counts {
+			if n == 0 {
+				continue
+			}
+			lo := strconv.FormatFloat(h.Buckets[i], 'g', -1, 64)
+			hi := strconv.FormatFloat(h.Buckets[i+1], 'g', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s,%s,%d\n", lo, hi, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// gcpauses reads the histogram of GC pause times.
+func gcpauses() (*metrics.Float64Histogram, error) {
+	for _, name := range gcpausemetrics {
+		s := []metrics.Sample{{Name: name}}
+		metrics.Read(s)
+		if s[0].Value.Kind() == metrics.KindFloat64Histogram {
+			return s[0].Value.Float64Histogram(), nil
+		}
+	}
+	return nil, errors.New("gc pause metric not supported")
+}
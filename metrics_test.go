@@ -0,0 +1,202 @@
+package profile_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestSchedTraceProfile(t *testing.T) {
+	fs := NewMemFS()
+	p := profile.New(
+		profile.SchedTraceProfile,
+		profile.WithFilesystem(fs),
+		profile.WithLogger(Logger(t)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-schedtrace=sched.out", "-schedtraceinterval=10ms"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start()
+	time.Sleep(100 * time.Millisecond)
+	p.Stop()
+
+	// Expect multiple sample lines.
+	lines := strings.Split(strings.TrimSpace(string(fs.Bytes("sched.out"))), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("expected multiple lines; got %d", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "SCHED ") || !strings.Contains(line, "goroutines=") {
+			t.Errorf("unexpected line %q", line)
+		}
+	}
+}
+
+func TestSchedTraceProfileStartStopSamples(t *testing.T) {
+	// Clock advances 1s on each call.
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	fs := NewMemFS()
+	p := profile.New(
+		profile.WithSchedTraceFile("sched.out"),
+		profile.WithFilesystem(fs),
+		profile.WithClock(clock),
+		profile.WithLogger(Logger(t)),
+	)
+	p.Start()
+	p.Stop()
+
+	// Expect samples at start and stop only, timed by the clock.
+	lines := strings.Split(strings.TrimSpace(string(fs.Bytes("sched.out"))), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines; got %d", len(lines))
+	}
+	for i, prefix := range []string{"SCHED 1000ms:", "SCHED 2000ms:"} {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("line %d: got %q; expect prefix %q", i, lines[i], prefix)
+		}
+	}
+}
+
+func TestMetricsProfile(t *testing.T) {
+	fs := NewMemFS()
+	p := profile.New(
+		profile.MetricsProfile,
+		profile.WithFilesystem(fs),
+		profile.WithLogger(Logger(t)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	args := []string{
+		"-metricsprofile=metrics.jsonl",
+		"-metricsinterval=10ms",
+		"-metricsnames=/gc/cycles/total:gc-cycles,/sched/goroutines:goroutines",
+	}
+	if err := f.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start()
+	time.Sleep(100 * time.Millisecond)
+	p.Stop()
+
+	// Expect multiple JSON lines containing the requested metrics.
+	s := bufio.NewScanner(bytes.NewReader(fs.Bytes("metrics.jsonl")))
+	n := 0
+	for s.Scan() {
+		var sample struct {
+			Metrics map[string]float64 `json:"metrics"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &sample); err != nil {
+			t.Fatal(err)
+		}
+		if len(sample.Metrics) != 2 {
+			t.Errorf("expected 2 metrics; got %v", sample.Metrics)
+		}
+		if sample.Metrics["/sched/goroutines:goroutines"] == 0 {
+			t.Errorf("expected non-zero goroutine count")
+		}
+		n++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n < 2 {
+		t.Fatalf("expected multiple lines; got %d", n)
+	}
+}
+
+func TestMetricsProfileStartStopSamples(t *testing.T) {
+	// Clock advances 1s on each call.
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	fs := NewMemFS()
+	p := profile.New(
+		profile.WithMetricsProfileFile("metrics.jsonl"),
+		profile.WithFilesystem(fs),
+		profile.WithClock(clock),
+		profile.WithLogger(Logger(t)),
+	)
+	p.Start()
+	p.Stop()
+
+	// Expect samples at start and stop only, timestamped by the clock.
+	var times []time.Time
+	s := bufio.NewScanner(bytes.NewReader(fs.Bytes("metrics.jsonl")))
+	for s.Scan() {
+		var sample struct {
+			Time time.Time `json:"time"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &sample); err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, sample.Time)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 2 {
+		t.Fatalf("expected 2 lines; got %d", len(times))
+	}
+	if times[0].Year() != 2021 || !times[1].After(times[0]) {
+		t.Fatalf("unexpected sample times %v", times)
+	}
+}
+
+func TestGCTraceProfile(t *testing.T) {
+	fs := NewMemFS()
+	p := profile.Start(
+		profile.WithGCTraceFile("gc.csv"),
+		profile.WithFilesystem(fs),
+		profile.WithLogger(Logger(t)),
+	)
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+	}
+	p.Stop()
+
+	// Parse the histogram and count pauses.
+	records, err := csv.NewReader(bytes.NewReader(fs.Bytes("gc.csv"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) < 2 {
+		t.Fatalf("expected non-empty buckets; got %v", records)
+	}
+
+	total := 0
+	for _, record := range records[1:] {
+		n, err := strconv.Atoi(record[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += n
+	}
+
+	// Each GC cycle has two stop-the-world pauses.
+	if total < 5 {
+		t.Fatalf("expected at least 5 pauses; got %d", total)
+	}
+}
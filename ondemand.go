@@ -0,0 +1,105 @@
+package profile
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// WithOnDemand binds signal sig to write a snapshot of the named profile, for
+// example "mem" or "goroutine", while profiling is running. Each snapshot is
+// written to a numbered file derived from the profile's output file, as with
+// WithPeriodicSnapshot. For example, binding SIGUSR1 to "goroutine" writes
+// goroutine-0001.pprof on the first signal, goroutine-0002.pprof on the second
+// and so on. Numbering is shared with periodic snapshots. The profile must be
+// enabled and support snapshots. Multiple bindings may be configured, but each
+// signal may be bound to only one profile. Conflicting and invalid bindings are
+// ignored, and reported as errors starting profiling.
+func WithOnDemand(sig os.Signal, name string) func(*Profile) {
+	return func(p *Profile) {
+		p.ondemand = append(p.ondemand, ondemandbinding{sig: sig, name: name})
+	}
+}
+
+// ondemandbinding binds a signal to a profile.
+type ondemandbinding struct {
+	sig  os.Signal
+	name string
+}
+
+// ondemand is a running handler for on-demand snapshot signals.
+type ondemand struct {
+	c    chan os.Signal
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startondemand starts handling on-demand snapshot signals, if configured.
+func (p *Profile) startondemand() {
+	if len(p.ondemand) == 0 || p.dryrun {
+		return
+	}
+
+	// Resolve bindings.
+	bindings := map[os.Signal]method{}
+	var sigs []os.Signal
+	for _, b := range p.ondemand {
+		if prev, ok := bindings[b.sig]; ok {
+			if prev.Name() != b.name {
+				p.log("ondemand: %v already bound to %s profile: ignoring binding to %s", b.sig, prev.Name(), b.name)
+				p.starterror(fmt.Errorf("ondemand: %v bound to both %s and %s profiles", b.sig, prev.Name(), b.name))
+			}
+			continue
+		}
+		m := p.method(b.name)
+		if m == nil || !m.Enabled() {
+			p.log("ondemand: %s profile: not enabled: ignoring binding to %v", b.name, b.sig)
+			p.starterror(fmt.Errorf("ondemand: %s profile: not enabled", b.name))
+			continue
+		}
+		if _, ok := m.(snapshotter); !ok {
+			p.log("ondemand: %s profile: snapshots not supported: ignoring binding to %v", b.name, b.sig)
+			p.starterror(fmt.Errorf("ondemand: %s profile: snapshots not supported", b.name))
+			continue
+		}
+		bindings[b.sig] = m
+		sigs = append(sigs, b.sig)
+	}
+	if len(sigs) == 0 {
+		return
+	}
+
+	// Write snapshots on receipt of signals.
+	d := &ondemand{
+		c:    make(chan os.Signal, len(sigs)),
+		done: make(chan struct{}),
+	}
+	p.notify(d.c, sigs...)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			select {
+			case <-d.done:
+				return
+			case s := <-d.c:
+				m := bindings[s]
+				p.info("ondemand: caught %v: writing %s profile", s, m.Name())
+				_ = p.snapshot([]method{m}, p.seqsnapshotname) // errors are logged
+			}
+		}
+	}()
+	p.demandhook = d
+}
+
+// stopondemand stops handling on-demand snapshot signals, if running.
+func (p *Profile) stopondemand() {
+	d := p.demandhook
+	if d == nil {
+		return
+	}
+	p.stopnotify(d.c)
+	close(d.done)
+	d.wg.Wait()
+	p.demandhook = nil
+}
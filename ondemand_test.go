@@ -0,0 +1,153 @@
+package profile_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+// testsignal is a fake signal.
+type testsignal string
+
+func (s testsignal) String() string { return string(s) }
+func (testsignal) Signal()          {}
+
+func TestWithOnDemand(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	usr1, usr2 := testsignal("usr1"), testsignal("usr2")
+
+	// Inject a signal source.
+	notified := make(chan chan<- os.Signal, 1)
+	buf := new(bytes.Buffer)
+	p := profile.Start(
+		profile.MemProfile,
+		profile.GoroutineProfile,
+		profile.WithOnDemand(usr1, "mem"),
+		profile.WithOnDemand(usr2, "goroutine"),
+		profile.WithOnDemand(usr1, "goroutine"),
+		profile.NoShutdownHook,
+		profile.WithNotifier(
+			func(c chan<- os.Signal, sig ...os.Signal) { notified <- c },
+			func(chan<- os.Signal) {},
+		),
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+
+	// Send signals, waiting for each snapshot to be written.
+	c := <-notified
+	for _, step := range []struct {
+		Signal   os.Signal
+		Filename string
+	}{
+		{usr1, "mem-0001.pprof"},
+		{usr2, "goroutine-0001.pprof"},
+		{usr1, "mem-0002.pprof"},
+	} {
+		c <- step.Signal
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, err := os.Stat(filepath.Join(dir, step.Filename)); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", step.Filename)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	p.Stop()
+
+	t.Log(buf.String())
+	expect := "ondemand: usr1 already bound to mem profile: ignoring binding to goroutine"
+	if !strings.Contains(buf.String(), expect) {
+		t.Errorf("expected %q in output", expect)
+	}
+
+	AssertDirContains(t, dir, []string{
+		"mem-0001.pprof",
+		"mem-0002.pprof",
+		"goroutine-0001.pprof",
+		"mem.pprof",
+		"goroutine.pprof",
+	})
+}
+
+func TestWithOnDemandPeriodicSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	usr1 := testsignal("usr1")
+
+	// Inject a signal source.
+	notified := make(chan chan<- os.Signal, 1)
+	buf := new(bytes.Buffer)
+	p := profile.Start(
+		profile.MemProfile,
+		profile.WithOnDemand(usr1, "mem"),
+		profile.WithPeriodicSnapshot(200*time.Millisecond),
+		profile.NoShutdownHook,
+		profile.WithNotifier(
+			func(c chan<- os.Signal, sig ...os.Signal) { notified <- c },
+			func(chan<- os.Signal) {},
+		),
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+
+	// Write an on-demand snapshot before the first periodic snapshot, then
+	// wait for the periodic snapshot.
+	c := <-notified
+	c <- usr1
+	for _, filename := range []string{"mem-0001.pprof", "mem-0002.pprof"} {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, err := os.Stat(filepath.Join(dir, filename)); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", filename)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	p.Stop()
+
+	// Verify each snapshot was written to its own file.
+	t.Log(buf.String())
+	if n := strings.Count(buf.String(), "snapshot written to mem-0001.pprof"); n != 1 {
+		t.Errorf("mem-0001.pprof written %d times; expect 1", n)
+	}
+}
+
+func TestWithOnDemandStrict(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	usr1 := testsignal("usr1")
+	p := profile.New(
+		profile.MemProfile,
+		profile.GoroutineProfile,
+		profile.WithOnDemand(usr1, "mem"),
+		profile.WithOnDemand(usr1, "goroutine"),
+		profile.WithStrict(),
+		profile.NoShutdownHook,
+		profile.WithNotifier(
+			func(chan<- os.Signal, ...os.Signal) {},
+			func(chan<- os.Signal) {},
+		),
+		profile.WithLogger(Logger(t)),
+	)
+	err := p.TryStart()
+	if err == nil || !strings.Contains(err.Error(), "usr1 bound to both mem and goroutine profiles") {
+		t.Fatalf("TryStart() = %v; expect conflicting binding error", err)
+	}
+}
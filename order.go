@@ -0,0 +1,84 @@
+package profile
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Methods are started in a fixed order of stages, regardless of the order they
+// were configured in, and stopped in reverse. Profiles that only configure
+// runtime sampling rates are started first, since they don't depend on timing.
+// The cpu profile and execution trace are innermost, so they are least
+// affected by starting and stopping other profiles, such as the garbage
+// collection forced when the memory profile is written. The execution trace
+// is started last and stopped first, so that it covers the whole cpu profile,
+// whose samples are also recorded in the trace.
+const (
+	stagerates = iota
+	stagedefault
+	stagecpu
+	stagetrace
+)
+
+// stage returns the start stage of method m.
+func stage(m method) int {
+	switch m.(type) {
+	case *mem, *fullmem, *deltamem, *block, *mutex:
+		return stagerates
+	case *cpu:
+		return stagecpu
+	case *tracer, *flightrecorder:
+		return stagetrace
+	default:
+		return stagedefault
+	}
+}
+
+// startorder returns methods in the order they should be started. Methods in
+// the same stage retain their configured order.
+func startorder(methods []method) []method {
+	ordered := append([]method(nil), methods...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return stage(ordered[i]) < stage(ordered[j])
+	})
+	return ordered
+}
+
+// WithMethodOrder configures the order profiles are started in, overriding the
+// default staged order. Profiles are started in the order named, and stopped
+// in reverse. Profiles not named are started afterwards, in the default order.
+// For example, WithMethodOrder("trace", "cpu") starts the execution trace
+// before the cpu profile, so it captures the cpu profile's setup, and stops it
+// last. Unknown names are ignored, and reported as an error starting
+// profiling.
+func WithMethodOrder(names ...string) func(*Profile) {
+	return func(p *Profile) { p.methodorder = names }
+}
+
+// startorder returns the configured methods in the order they should be
+// started, applying the order configured with WithMethodOrder if any.
+func (p *Profile) startorder() []method {
+	var ordered []method
+	named := map[method]bool{}
+	for _, name := range p.methodorder {
+		m := p.method(name)
+		switch {
+		case m == nil:
+			p.log("order: unknown profile %q: ignoring", name)
+			p.starterror(fmt.Errorf("order: unknown profile %q", name))
+			continue
+		case named[m]:
+			continue
+		}
+		ordered = append(ordered, m)
+		named[m] = true
+	}
+
+	for _, m := range startorder(p.methods) {
+		if !named[m] {
+			ordered = append(ordered, m)
+		}
+	}
+
+	return ordered
+}
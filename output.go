@@ -0,0 +1,495 @@
+package profile
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+)
+
+// Filesystem is a destination for profile output files.
+type Filesystem interface {
+	// Create creates the named file for writing, truncating it if it already
+	// exists.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// WithFilesystem configures profiles to be written to the given filesystem.
+// Defaults to the operating system filesystem.
+//
+// On Unix, the operating system filesystem supports output to named pipes, so
+// a profile may be streamed to a reader as it's written. For example, with the
+// cpu profile written to a pipe created by mkfifo, the profile may be read as
+// soon as profiling stops. The pipe must be opened for reading before
+// profiling starts, otherwise the profile fails to start.
+func WithFilesystem(fs Filesystem) func(*Profile) {
+	return func(p *Profile) { p.fs = fs }
+}
+
+// WithOutputDirs configures output directories for individual profiles, keyed
+// by profile name, for example "cpu" or "trace". Relative output filenames of
+// these profiles are resolved against the given directory. Profiles without an
+// entry use the directory configured by WithOutputDir, if any. Directories must
+// exist.
+func WithOutputDirs(dirs map[string]string) func(*Profile) {
+	return func(p *Profile) {
+		if p.outputdirs == nil {
+			p.outputdirs = map[string]string{}
+		}
+		for name, dir := range dirs {
+			p.outputdirs[name] = dir
+		}
+	}
+}
+
+// WithOutputDir configures relative output filenames to be resolved against
+// the given directory, rather than the current working directory. The
+// directory must exist.
+func WithOutputDir(dir string) func(*Profile) {
+	return func(p *Profile) { p.outputdir = dir }
+}
+
+// WithWriteRetries configures the number of times writing a profile is retried
+// after a transient error, such as may be encountered on network filesystems.
+// Retries back off exponentially. Defaults to 0.
+func WithWriteRetries(n int) func(*Profile) {
+	return func(p *Profile) { p.writeretries = n }
+}
+
+// writebackoff is the delay before the first write retry.
+const writebackoff = 10 * time.Millisecond
+
+// transient reports whether err is a filesystem error that may succeed if
+// retried.
+func transient(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
+
+// osfs is a Filesystem backed by the operating system.
+type osfs struct{}
+
+func (osfs) Create(name string) (io.WriteCloser, error) {
+	if isfifo(name) {
+		return openfifo(name)
+	}
+	return os.Create(name)
+}
+
+// WithDiscardEmpty configures empty output files to be removed when they are
+// closed, rather than left behind. For example, a profile that fails to start
+// may leave an empty file. Only supported for the operating system filesystem.
+func WithDiscardEmpty() func(*Profile) {
+	return func(p *Profile) { p.discardempty = true }
+}
+
+// WithFsync configures output files to be synced to stable storage before they
+// are closed, so profiles survive a crash or power loss. Only applies to files
+// that support syncing, such as those of the operating system filesystem.
+func WithFsync() func(*Profile) {
+	return func(p *Profile) { p.fsync = true }
+}
+
+// syncer is implemented by files that can be synced to stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// syncwriter syncs the underlying file before closing.
+type syncwriter struct {
+	io.WriteCloser
+	s syncer
+}
+
+func (w syncwriter) Close() error {
+	if err := w.s.Sync(); err != nil {
+		_ = w.WriteCloser.Close() // best effort: ignore error since we already have one
+		return err
+	}
+	return w.WriteCloser.Close()
+}
+
+// WithDeterministicOutput configures profiles written at Stop in pprof format
+// to be canonicalized: samples, locations, functions and mappings are sorted,
+// and timestamps, addresses and mapping ranges are cleared. The same workload
+// then produces byte-identical output, even across processes with different
+// address space layouts, which is useful for golden-file tests. Since
+// addresses are cleared, the output can only be symbolized by function name.
+// Does not apply to the cpu profile or execution trace, or to profiles written
+// in legacy text formats.
+func WithDeterministicOutput() func(*Profile) {
+	return func(p *Profile) { p.deterministic = true }
+}
+
+// rewrite wraps a function writing a profile in pprof format to transform the
+// profile with fn before it is written.
+func rewrite(write func(w io.Writer) error, fn func(*pprofile.Profile) *pprofile.Profile) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		buf := new(bytes.Buffer)
+		if err := write(buf); err != nil {
+			return err
+		}
+		prof, err := pprofile.Parse(buf)
+		if err != nil {
+			return err
+		}
+		return fn(prof).Write(w)
+	}
+}
+
+// remover is implemented by filesystems that can remove files.
+type remover interface {
+	remove(name string) error
+}
+
+func (osfs) remove(name string) error { return os.Remove(name) }
+
+// checker is implemented by filesystems that can check whether a file can be
+// created, without side effects.
+type checker interface {
+	check(name string) error
+}
+
+// check verifies the named file can be written. Existing files are opened
+// without truncation, otherwise the file is created and then removed.
+func (osfs) check(name string) error {
+	if isfifo(name) {
+		return nil // opening would block until there is a reader
+	}
+	if _, err := os.Stat(name); err == nil {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// outfile is the output file configuration of a method.
+type outfile struct {
+	filename string
+	flag     string
+	explicit bool
+	seq      int
+}
+
+// Filename returns the output filename. An empty filename indicates the method
+// is disabled.
+func (o *outfile) Filename() string { return o.filename }
+
+// setfilename explicitly sets the output filename.
+func (o *outfile) setfilename(filename string) {
+	o.filename = filename
+	o.explicit = true
+}
+
+// sequence returns the current sequence number.
+func (o *outfile) sequence() int { return o.seq }
+
+// nextsequence increments the sequence number.
+func (o *outfile) nextsequence() { o.seq++ }
+
+// setdefault sets the output filename, unless it has been explicitly set.
+func (o *outfile) setdefault(filename string) {
+	if !o.explicit {
+		o.filename = filename
+	}
+}
+
+// fileflag registers a flag to configure the output filename. The flag
+// defaults to disabled, unless the filename has been explicitly set.
+func (o *outfile) fileflag(f *flag.FlagSet, usage string) {
+	value := ""
+	if o.explicit {
+		value = o.filename
+	}
+	f.StringVar(&o.filename, o.flag, value, usage)
+}
+
+// fileflagname returns the name of the flag that configures the output
+// filename.
+func (o *outfile) fileflagname() string { return o.flag }
+
+// setfileflagname sets the name of the flag that configures the output
+// filename.
+func (o *outfile) setfileflagname(name string) { o.flag = name }
+
+// WithNamer configures a function to compute the default output filename of
+// each profile from its name, for example "cpu" or "goroutine". Filenames set
+// explicitly, by options or flags, take precedence.
+func WithNamer(namer func(name string) string) func(*Profile) {
+	return func(p *Profile) { p.namer = namer }
+}
+
+// WithDefaultExtension configures default output filenames to be the profile
+// name with the given extension. For example, with extension ".prof" the
+// default cpu profile filename is "cpu.prof".
+func WithDefaultExtension(ext string) func(*Profile) {
+	return WithNamer(func(name string) string { return name + ext })
+}
+
+// defaulter is implemented by methods with a default output filename.
+type defaulter interface {
+	setdefault(filename string)
+}
+
+// applynamer sets default filenames with the configured namer. Methods with
+// registered flags are skipped, since their defaults have been replaced by
+// the flag defaults.
+func (p *Profile) applynamer() {
+	if p.namer == nil {
+		return
+	}
+	for _, m := range p.methods {
+		d, ok := m.(defaulter)
+		if _, registered := p.flags[m]; !ok || registered {
+			continue
+		}
+		d.setdefault(p.namer(m.Name()))
+	}
+}
+
+// WithSequence configures a sequence number to be inserted into output
+// filenames, incremented each time profiling is started. For example, the cpu
+// profile of the third session started is written to cpu-0003.pprof. This
+// avoids overwriting output when a session is started repeatedly.
+func WithSequence() func(*Profile) {
+	return func(p *Profile) { p.sequence = true }
+}
+
+// sequencer is implemented by methods with sequence numbers.
+type sequencer interface {
+	sequence() int
+	nextsequence()
+}
+
+// nextsequence advances the sequence number of method m, if enabled.
+func (p *Profile) nextsequence(m method) {
+	if s, ok := m.(sequencer); ok && p.sequence {
+		s.nextsequence()
+	}
+}
+
+// outputname inserts the session ID and the sequence number of method m into
+// filename, if enabled.
+func (p *Profile) outputname(m method, filename string) string {
+	if p.idfilenames && p.id != "" {
+		filename = idfilename(filename, p.id)
+	}
+	if s, ok := m.(sequencer); ok && p.sequence {
+		return seqfilename(filename, s.sequence())
+	}
+	return filename
+}
+
+// withfile returns an option that sets the output filename of the named
+// method, first applying option to add the method if it's not already present.
+func withfile(name string, option func(*Profile), filename string) func(*Profile) {
+	return func(p *Profile) {
+		m := p.method(name)
+		if m == nil {
+			p.Configure(option)
+			m = p.method(name)
+		}
+		m.setfilename(filename)
+	}
+}
+
+// seqfilename inserts the sequence number n into filename, before the
+// extension. For example, sequence number 3 of "cpu.pprof" is
+// "cpu-0003.pprof".
+func seqfilename(filename string, n int) string {
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(filename, ext), n, ext)
+}
+
+// idfilename inserts the session ID into filename, before the extension.
+func idfilename(filename, id string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + id + ext
+}
+
+// timefilename inserts the timestamp t into filename, before the extension.
+func timefilename(filename string, t time.Time) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + t.Format("20060102T150405.000") + ext
+}
+
+// path resolves filename against the run directory and output directory, if
+// configured.
+func (p *Profile) path(filename string) string {
+	if p.runpath != "" && !filepath.IsAbs(filename) {
+		filename = filepath.Join(p.runpath, filename)
+	}
+	return p.basepath(filename)
+}
+
+// basepath resolves filename against the output directory, if configured,
+// bypassing the run directory.
+func (p *Profile) basepath(filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	if p.outputdir != "" {
+		filename = filepath.Join(p.outputdir, filename)
+	}
+	return filename
+}
+
+// methodpath resolves an output filename of method m, inserting its sequence
+// number and resolving against its output directory, if configured, and then
+// the global output directory.
+func (p *Profile) methodpath(m method, filename string) string {
+	filename = p.outputname(m, filename)
+	if dir := p.outputdirs[m.Name()]; dir != "" && !filepath.IsAbs(filename) {
+		filename = filepath.Join(dir, filename)
+	}
+	return p.path(filename)
+}
+
+// outputpath returns the path the named output file of method m is written
+// to: a URL, a path within the archive, or a path on the filesystem.
+func (p *Profile) outputpath(m method, filename string) string {
+	switch {
+	case isurl(filename):
+		return filename
+	case p.archive != nil:
+		return p.outputname(m, filename)
+	default:
+		return p.methodpath(m, filename)
+	}
+}
+
+// create opens the named output file of method m for writing.
+func (p *Profile) create(m method, filename string) (w io.WriteCloser, err error) {
+	path := p.outputpath(m, filename)
+	switch {
+	case isurl(filename):
+		w, err = p.openurl(filename)
+	case p.archive != nil:
+		w, err = p.archive.Create(path)
+	default:
+		w, err = p.fs.Create(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := w.(syncer); ok && p.fsync {
+		w = syncwriter{WriteCloser: w, s: s}
+	}
+
+	return p.track(m, path, w), nil
+}
+
+// track wraps the output file w of method m to record its size when closed,
+// for the manifest, to discard empty output and to count bytes written.
+func (p *Profile) track(m method, path string, w io.WriteCloser) io.WriteCloser {
+	return &countwriter{
+		WriteCloser: w,
+		close: func(n int64) {
+			p.addwritten(m, n)
+			if n == 0 && p.discard(m, path) {
+				return
+			}
+			p.manifest.file(m, path, n)
+		},
+	}
+}
+
+// BytesWritten returns the number of bytes written by each profile, keyed by
+// profile name, since profiling was last started. Output files are counted
+// when they are closed, so the counts are complete once profiling has stopped.
+// Failed writes are not counted, including failed attempts at retried writes.
+func (p *Profile) BytesWritten() map[string]int64 {
+	p.writtenmu.Lock()
+	defer p.writtenmu.Unlock()
+	written := make(map[string]int64, len(p.written))
+	for name, n := range p.written {
+		written[name] = n
+	}
+	return written
+}
+
+// addwritten records n bytes written by method m.
+func (p *Profile) addwritten(m method, n int64) {
+	p.writtenmu.Lock()
+	defer p.writtenmu.Unlock()
+	if p.written == nil {
+		p.written = map[string]int64{}
+	}
+	p.written[m.Name()] += n
+}
+
+// resetwritten clears the counts of bytes written.
+func (p *Profile) resetwritten() {
+	p.writtenmu.Lock()
+	defer p.writtenmu.Unlock()
+	p.written = nil
+}
+
+// discard removes the empty output file of method m, if enabled and supported
+// by the filesystem. Reports whether the file was removed.
+func (p *Profile) discard(m method, path string) bool {
+	if !p.discardempty || p.archive != nil || isurl(path) || isfifo(path) {
+		return false
+	}
+	r, ok := p.fs.(remover)
+	if !ok {
+		return false
+	}
+	if err := r.remove(path); err != nil {
+		p.log("%s profile: error discarding empty output %s: %v", m.Name(), path, err)
+		return false
+	}
+	p.info("%s profile: discarded empty output %s", m.Name(), path)
+	return true
+}
+
+// checkwritable verifies that the named output file of method m can be
+// written, where supported by the filesystem. This allows misconfigured output
+// to be reported at Start, before any runtime profiling settings have been
+// changed.
+func (p *Profile) checkwritable(m method, filename string) error {
+	if p.archive != nil || filename == "" || isurl(filename) {
+		return nil
+	}
+	if c, ok := p.fs.(checker); ok {
+		return c.check(p.methodpath(m, filename))
+	}
+	return nil
+}
+
+// writefile creates the named output file of method m and writes to it with the
+// given function.
+func (p *Profile) writefile(m method, filename string, write func(w io.Writer) error) (err error) {
+	// Open file.
+	f, err := p.create(m, filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errc := f.Close(); err == nil && errc != nil {
+			err = errc
+		}
+	}()
+
+	// Write.
+	return write(f)
+}
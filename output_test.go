@@ -0,0 +1,658 @@
+package profile_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Run profiler writing to an in-memory filesystem.
+	fs := NewMemFS()
+	profile.Start(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithFilesystem(fs),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	// Verify the profiles were captured in memory and not on disk.
+	for _, filename := range []string{"cpu.pprof", "mem.pprof"} {
+		if len(fs.Bytes(filename)) == 0 {
+			t.Errorf("expected non-empty file %q", filename)
+		}
+	}
+	AssertDirContains(t, dir, nil)
+}
+
+func TestWriteRetries(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Err     error
+		Retries int
+		Expect  bool
+	}{
+		{Name: "transient", Err: syscall.EAGAIN, Retries: 1, Expect: true},
+		{Name: "no_retries", Err: syscall.EAGAIN, Retries: 0, Expect: false},
+		{Name: "permanent", Err: syscall.ENOSPC, Retries: 1, Expect: false},
+	}
+	for _, c := range cases {
+		c := c // scopelint
+		t.Run(c.Name, func(t *testing.T) {
+			fs := &FlakyFS{MemFS: NewMemFS(), Err: c.Err, Failures: 1}
+			profile.Start(
+				profile.MemProfile,
+				profile.WithFilesystem(fs),
+				profile.WithWriteRetries(c.Retries),
+				profile.WithLogger(Logger(t)),
+			).Stop()
+
+			if got := len(fs.Bytes("mem.pprof")) > 0; got != c.Expect {
+				t.Fatalf("profile written = %v; expect %v", got, c.Expect)
+			}
+		})
+	}
+}
+
+func TestWriteRetriesCountedOnce(t *testing.T) {
+	fs := &FlakyFS{MemFS: NewMemFS(), Err: syscall.EAGAIN, Failures: 1}
+	p := profile.Start(
+		profile.MemProfile,
+		profile.WithFilesystem(fs),
+		profile.WithWriteRetries(1),
+		profile.WithManifest("manifest.json"),
+		profile.WithLogger(Logger(t)),
+	)
+	p.Stop()
+
+	// Verify the manifest lists the profile once, with its final size.
+	var manifest struct {
+		Profiles []struct {
+			Name  string `json:"name"`
+			Files []struct {
+				Path string `json:"path"`
+				Size int64  `json:"size"`
+			} `json:"files"`
+		} `json:"profiles"`
+	}
+	if err := json.Unmarshal(fs.Bytes("manifest.json"), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(fs.Bytes("mem.pprof")))
+	if len(manifest.Profiles) != 1 || len(manifest.Profiles[0].Files) != 1 || manifest.Profiles[0].Files[0].Size != size {
+		t.Fatalf("unexpected manifest %+v; expect one file of size %d", manifest, size)
+	}
+
+	if n := p.BytesWritten()["mem"]; n != size {
+		t.Fatalf("BytesWritten() = %d; expect %d", n, size)
+	}
+}
+
+// FlakyFS is an in-memory filesystem where writes fail a given number of
+// times before succeeding.
+type FlakyFS struct {
+	*MemFS
+	Err      error
+	Failures int
+}
+
+// Create creates the named file.
+func (fs *FlakyFS) Create(name string) (io.WriteCloser, error) {
+	w, err := fs.MemFS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if fs.Failures > 0 {
+		fs.Failures--
+		return flakyWriter{w, &os.PathError{Op: "write", Path: name, Err: fs.Err}}, nil
+	}
+	return w, nil
+}
+
+type flakyWriter struct {
+	io.WriteCloser
+	err error
+}
+
+func (w flakyWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestWithOutputDirs(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	cpudir, tracedir, memdir := t.TempDir(), t.TempDir(), t.TempDir()
+	profile.Start(
+		profile.CPUProfile,
+		profile.TraceProfile,
+		profile.MemProfile,
+		profile.WithOutputDirs(map[string]string{
+			"cpu":   cpudir,
+			"trace": tracedir,
+		}),
+		profile.WithOutputDir(memdir),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	AssertDirContains(t, cpudir, []string{"cpu.pprof"})
+	AssertDirContains(t, tracedir, []string{"trace.out"})
+	AssertDirContains(t, memdir, []string{"mem.pprof"})
+	AssertDirContains(t, dir, nil)
+}
+
+func TestWithRunDir(t *testing.T) {
+	dir := t.TempDir()
+	outdir := t.TempDir()
+	Chdir(t, dir)
+
+	// Start two runs at different times.
+	now := time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		profile.Start(
+			profile.CPUProfile,
+			profile.MemProfile,
+			profile.WithRunDir(),
+			profile.WithOutputDir(outdir),
+			profile.WithClock(func() time.Time { return now }),
+			profile.WithLogger(Logger(t)),
+		).Stop()
+		now = now.Add(time.Second)
+	}
+
+	// Expect a directory per run, each containing its output.
+	pid := os.Getpid()
+	base := filepath.Join(outdir, "profiles")
+	entries, err := ioutil.ReadDir(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d run directories; expect 2", len(entries))
+	}
+	for _, name := range []string{
+		fmt.Sprintf("20210102T150405.000-%d", pid),
+		fmt.Sprintf("20210102T150406.000-%d", pid),
+	} {
+		AssertDirContains(t, filepath.Join(base, name), []string{"cpu.pprof", "mem.pprof"})
+	}
+	AssertDirContains(t, dir, nil)
+}
+
+func TestWithRunDirCollision(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Start two runs at the same time.
+	now := time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		profile.Start(
+			profile.MemProfile,
+			profile.WithRunDir(),
+			profile.WithClock(func() time.Time { return now }),
+			profile.WithLogger(Logger(t)),
+		).Stop()
+	}
+
+	// Expect the second run directory to be suffixed.
+	name := fmt.Sprintf("20210102T150405.000-%d", os.Getpid())
+	for _, run := range []string{name, name + "-2"} {
+		AssertDirContains(t, filepath.Join(dir, "profiles", run), []string{"mem.pprof"})
+	}
+}
+
+func TestWithRunDirMergeInto(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	now := time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		profile.Start(
+			profile.CPUProfile,
+			profile.WithRunDir(),
+			profile.WithMergeInto("merged.pprof"),
+			profile.WithClock(func() time.Time { return now }),
+			profile.WithLogger(Logger(t)),
+		).Stop()
+		now = now.Add(time.Second)
+	}
+
+	// Expect the accumulated profile outside the run directories.
+	if _, err := os.Stat("merged.pprof"); err != nil {
+		t.Fatal(err)
+	}
+	pid := os.Getpid()
+	for _, run := range []string{
+		fmt.Sprintf("20210102T150405.000-%d", pid),
+		fmt.Sprintf("20210102T150406.000-%d", pid),
+	} {
+		AssertDirContains(t, filepath.Join(dir, "profiles", run), []string{"cpu.pprof"})
+	}
+}
+
+func TestStartLogFilename(t *testing.T) {
+	dir := t.TempDir()
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.WithCPUProfileFile("cpu.out"),
+		profile.WithOutputDir(dir),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	t.Log(buf.String())
+	expect := "cpu profile: started (" + filepath.Join(dir, "cpu.out") + ")"
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatalf("expected %q in output", expect)
+	}
+}
+
+func TestStartLogCurrentFile(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Options []func(*profile.Profile)
+		Expect  string
+	}{
+		{
+			Name:    "rotation",
+			Options: []func(*profile.Profile){profile.CPUProfile, profile.WithRotation(1<<20, 0)},
+			Expect:  "cpu profile: started (cpu-0001.pprof)\n",
+		},
+		{
+			Name:    "interval",
+			Options: []func(*profile.Profile){profile.CPUProfile, profile.WithInterval(time.Hour)},
+			Expect:  "cpu profile: started (cpu-0001.pprof)\n",
+		},
+		{
+			Name:    "trace_split",
+			Options: []func(*profile.Profile){profile.TraceProfile, profile.WithTraceSplit(time.Hour)},
+			Expect:  "trace profile: started (trace-0001.out)\n",
+		},
+		{
+			Name:    "gate",
+			Options: []func(*profile.Profile){profile.CPUProfile, profile.WithGate(func() bool { return false }, time.Hour)},
+			Expect:  "cpu profile: started\n",
+		},
+		{
+			Name:    "http",
+			Options: []func(*profile.Profile){profile.HTTPHandler("localhost:0", http.NotFoundHandler())},
+			Expect:  "http profile: started\n",
+		},
+	}
+	for _, c := range cases {
+		c := c // scopelint
+		t.Run(c.Name, func(t *testing.T) {
+			Chdir(t, t.TempDir())
+
+			buf := new(bytes.Buffer)
+			opts := append(c.Options, profile.WithLogger(log.New(buf, "", 0)))
+			profile.Start(opts...).Stop()
+
+			t.Log(buf.String())
+			if !strings.Contains(buf.String(), c.Expect) {
+				t.Fatalf("expected %q in output", c.Expect)
+			}
+		})
+	}
+}
+
+func TestWithSequence(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithSequence(),
+		profile.NoShutdownHook,
+		profile.WithLogger(Logger(t)),
+	)
+	for i := 0; i < 3; i++ {
+		p.Start().Stop()
+	}
+
+	AssertDirContains(t, dir, []string{
+		"cpu-0001.pprof", "cpu-0002.pprof", "cpu-0003.pprof",
+		"mem-0001.pprof", "mem-0002.pprof", "mem-0003.pprof",
+	})
+}
+
+func TestWithDiscardEmpty(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Start a cpu profile, so that a second will fail to start, leaving an
+	// empty output file.
+	first := profile.Start(profile.WithCPUProfileFile("first.pprof"), profile.WithLogger(Logger(t)))
+	defer first.Stop()
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.WithCPUProfileFile("second.pprof"),
+		profile.WithDiscardEmpty(),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+	first.Stop()
+
+	t.Log(buf.String())
+	if !strings.Contains(buf.String(), "cpu profile: discarded empty output second.pprof") {
+		t.Fatal("expected log about discarded output")
+	}
+	AssertDirContains(t, dir, []string{"first.pprof"})
+}
+
+func TestWithFsync(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	profile.Start(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.TraceProfile,
+		profile.WithFsync(),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	AssertDirContains(t, dir, []string{"cpu.pprof", "mem.pprof", "trace.out"})
+}
+
+func TestWithFsyncBeforeClose(t *testing.T) {
+	fs := &SyncFS{MemFS: NewMemFS()}
+	profile.Start(
+		profile.MemProfile,
+		profile.WithFilesystem(fs),
+		profile.WithFsync(),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	if fs.Synced != 1 {
+		t.Fatalf("got %d syncs before close; expect 1", fs.Synced)
+	}
+}
+
+// SyncFS is an in-memory filesystem that counts files synced before they are
+// closed.
+type SyncFS struct {
+	*MemFS
+	Synced int
+}
+
+// Create creates the named file.
+func (fs *SyncFS) Create(name string) (io.WriteCloser, error) {
+	w, err := fs.MemFS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncFile{WriteCloser: w, fs: fs}, nil
+}
+
+type syncFile struct {
+	io.WriteCloser
+	fs     *SyncFS
+	synced bool
+}
+
+func (f *syncFile) Sync() error {
+	f.synced = true
+	return nil
+}
+
+func (f *syncFile) Close() error {
+	if f.synced {
+		f.fs.Synced++
+	}
+	return f.WriteCloser.Close()
+}
+
+func TestWithDeterministicOutput(t *testing.T) {
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		outputs = append(outputs, DeterministicGoroutineProfile(t))
+	}
+
+	if len(outputs[0]) == 0 {
+		t.Fatal("expected goroutine profile output")
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatal("expected byte-identical output")
+	}
+}
+
+// deterministicpathenv is the environment variable that directs the test
+// binary, re-executed by TestWithDeterministicOutputProcesses, to write a
+// deterministic profile to the given path.
+const deterministicpathenv = "PROFILE_TEST_DETERMINISTIC_PATH"
+
+func TestWithDeterministicOutputProcesses(t *testing.T) {
+	// In the re-executed test binary, write the profile and exit.
+	if path := os.Getenv(deterministicpathenv); path != "" {
+		if err := ioutil.WriteFile(path, DeterministicGoroutineProfile(t), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// Write profiles from separate processes, whose address space layouts
+	// differ when built as position-independent executables, for example with
+	// -buildmode=pie.
+	dir := t.TempDir()
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("goroutine%d.pprof", i))
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWithDeterministicOutputProcesses$")
+		cmd.Env = append(os.Environ(), deterministicpathenv+"="+path)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("test process: %v\n%s", err, out)
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, b)
+	}
+
+	if len(outputs[0]) == 0 {
+		t.Fatal("expected goroutine profile output")
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatal("expected byte-identical output across processes")
+	}
+}
+
+// DeterministicGoroutineProfile writes a goroutine profile of a fixed set of
+// blocked goroutines, with deterministic output, and returns its contents.
+func DeterministicGoroutineProfile(t *testing.T) []byte {
+	t.Helper()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-done
+		}()
+	}
+	defer wg.Wait()
+	defer close(done)
+	time.Sleep(50 * time.Millisecond) // allow goroutines to block
+
+	fs := NewMemFS()
+	profile.Start(
+		profile.GoroutineProfile,
+		profile.WithFilesystem(fs),
+		profile.WithDeterministicOutput(),
+		profile.NoShutdownHook,
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	return fs.Bytes("goroutine.pprof")
+}
+
+func TestBytesWritten(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithLogger(Logger(t)),
+	)
+	spin(10 * time.Millisecond)
+	p.Stop()
+
+	written := p.BytesWritten()
+	t.Log(written)
+
+	expect := map[string]string{"cpu": "cpu.pprof", "mem": "mem.pprof"}
+	if len(written) != len(expect) {
+		t.Fatalf("got counts for %d profiles; expect %d", len(written), len(expect))
+	}
+	for name, filename := range expect {
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written[name] <= 0 || written[name] != info.Size() {
+			t.Errorf("%s profile: %d bytes written; file size %d", name, written[name], info.Size())
+		}
+	}
+}
+
+func TestWithNamer(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	profile.Start(
+		profile.CPUProfile,
+		profile.TraceProfile,
+		profile.WithMemProfileFile("explicit.mem"),
+		profile.WithNamer(func(name string) string { return "app-" + name + ".prof" }),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	AssertDirContains(t, dir, []string{"app-cpu.prof", "app-trace.prof", "explicit.mem"})
+}
+
+func TestWithDefaultExtensionFlags(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithDefaultExtension(".prof"),
+		profile.WithLogger(Logger(t)),
+	)
+
+	// Flags take precedence over the namer.
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-memprofile=flag.mem"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	AssertDirContains(t, dir, []string{"flag.mem"})
+}
+
+// MemFS is an in-memory filesystem.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*bytes.Buffer
+}
+
+// NewMemFS builds an empty in-memory filesystem.
+func NewMemFS() *MemFS {
+	return &MemFS{files: map[string]*bytes.Buffer{}}
+}
+
+// Create creates the named file.
+func (fs *MemFS) Create(name string) (io.WriteCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	buf := new(bytes.Buffer)
+	fs.files[name] = buf
+	return nopCloser{buf}, nil
+}
+
+// Bytes returns the contents of the named file, or nil if it doesn't exist.
+func (fs *MemFS) Bytes(name string) []byte {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if buf, ok := fs.files[name]; ok {
+		return buf.Bytes()
+	}
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestUnwritableOutput(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	p := profile.Start(
+		profile.WithMemProfileFile(filepath.Join(dir, "missing", "mem.pprof")),
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+
+	// Expect the error to be reported by Start.
+	t.Log(buf.String())
+	if !strings.Contains(buf.String(), "mem profile: error starting") {
+		t.Fatal("expected error starting mem profile")
+	}
+
+	buf.Reset()
+	p.Stop()
+
+	// Profile was not started, so there's nothing to stop.
+	t.Log(buf.String())
+	if strings.Contains(buf.String(), "mem profile") {
+		t.Fatal("unexpected mem profile log output at stop")
+	}
+	AssertDirContains(t, dir, nil)
+}
+
+func TestCheckPreservesExistingOutput(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	if err := ioutil.WriteFile("mem.pprof", []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Checking the existing file at Start should not modify it.
+	p := profile.Start(profile.MemProfile, profile.WithLogger(Logger(t)))
+	b, err := ioutil.ReadFile("mem.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "existing" {
+		t.Fatal("expected existing file to be unmodified by Start")
+	}
+	p.Stop()
+}
@@ -0,0 +1,56 @@
+package profile
+
+// PauseTrace stops a running execution trace, writing the current segment,
+// until ResumeTrace is called. This brackets the trace around operations of
+// interest. Has no effect if the execution trace is not running or already
+// paused. Not supported with WithRotation.
+func (p *Profile) PauseTrace() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.runningmethod("trace").(*tracer)
+	switch {
+	case !ok:
+		p.log("trace profile: not running: cannot pause")
+		return
+	case t.rotator != nil:
+		p.log("trace profile: cannot pause with rotation")
+		return
+	case t.f == nil:
+		p.log("trace profile: already paused")
+		return
+	}
+
+	if err := t.stop(p); err != nil {
+		p.log("trace profile: error pausing: %v", err)
+		return
+	}
+	p.info("trace profile: paused")
+}
+
+// ResumeTrace resumes a paused execution trace. Each resumed segment is
+// written to a new numbered file. For example, with the default filename the
+// first segment is written to trace.out, the second to trace-0002.out and so
+// on. Has no effect if the execution trace is not paused.
+func (p *Profile) ResumeTrace() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.runningmethod("trace").(*tracer)
+	switch {
+	case !ok:
+		p.log("trace profile: not running: cannot resume")
+		return
+	case t.rotator != nil || t.f != nil:
+		p.log("trace profile: not paused: cannot resume")
+		return
+	}
+
+	t.segment++
+	filename := seqfilename(t.filename, t.segment)
+	if err := t.start(p, filename); err != nil {
+		p.log("trace profile: error resuming: %v", err)
+		return
+	}
+	p.info("trace profile: resumed: writing %s", filename)
+}
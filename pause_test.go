@@ -0,0 +1,100 @@
+package profile_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"runtime/trace"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestPauseResumeTrace(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(profile.TraceProfile, profile.WithLogger(Logger(t)))
+	contend()
+	p.PauseTrace()
+	contend()
+	p.ResumeTrace()
+	contend()
+	p.PauseTrace()
+	p.ResumeTrace()
+	contend()
+	p.Stop()
+
+	// Expect one file per segment, each a complete trace.
+	filenames := []string{"trace.out", "trace-0002.out", "trace-0003.out"}
+	AssertDirContains(t, dir, filenames)
+	for _, filename := range filenames {
+		b, err := ioutil.ReadFile(filepath.Join(dir, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, []byte("go 1.")) {
+			t.Fatalf("%s: missing trace header", filename)
+		}
+	}
+}
+
+func TestPauseTraceNotRunning(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	p := profile.Start(profile.MemProfile, profile.WithLogger(log.New(buf, "", 0)))
+	p.PauseTrace()
+	p.ResumeTrace()
+	p.Stop()
+
+	t.Log(buf.String())
+	for _, expect := range []string{
+		"trace profile: not running: cannot pause",
+		"trace profile: not running: cannot resume",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected %q in output", expect)
+		}
+	}
+}
+
+func TestWithTraceSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	p := profile.Start(
+		profile.TraceProfile,
+		profile.WithTraceSizeLimit(1),
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+
+	// Expect the trace to stop before profiling does.
+	deadline := time.Now().Add(5 * time.Second)
+	for trace.IsEnabled() {
+		if time.Now().After(deadline) {
+			t.Fatal("trace did not stop at size limit")
+		}
+		contend()
+	}
+	p.Stop()
+
+	t.Log(buf.String())
+	expect := "trace profile: truncated at size limit of 1 bytes"
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatalf("expected %q in output", expect)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "trace.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("go 1.")) {
+		t.Fatal("missing trace header")
+	}
+}
@@ -0,0 +1,38 @@
+package profile
+
+import (
+	"sync"
+	"time"
+)
+
+// poller runs a function periodically in a background goroutine.
+type poller struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// poll calls fn every interval until the returned poller is stopped.
+func poll(interval time.Duration, fn func()) *poller {
+	pl := &poller{done: make(chan struct{})}
+	pl.wg.Add(1)
+	go func() {
+		defer pl.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-pl.done:
+				return
+			case <-t.C:
+				fn()
+			}
+		}
+	}()
+	return pl
+}
+
+// stop the poller and wait for the background goroutine to exit.
+func (pl *poller) stop() {
+	close(pl.done)
+	pl.wg.Wait()
+}
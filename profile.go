@@ -2,29 +2,131 @@
 package profile
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
 )
 
 // Profile represents a profiling session.
 type Profile struct {
 	methods        []method
-	log            func(string, ...interface{})
+	name           string
+	id             string
+	idfilenames    bool
+	logf           func(string, ...interface{})
+	verbosity      int
+	quietmethods   map[string]bool
 	noshutdownhook bool
-	envvar         string
+	nodefault      bool
+	sources        []func() error
+	flagprefix     string
+	flagnames      map[string]string
+	fs             Filesystem
+	outputdir      string
+	writeretries   int
+	archivepath    string
+	openbrowser    string
+	gate           func() bool
+	gateinterval   time.Duration
+	shutdownfuncs  []func()
+	noshutdownexit bool
+	exit           func(int)
+	notify         func(chan<- os.Signal, ...os.Signal)
+	stopnotify     func(chan<- os.Signal)
+	clock          func() time.Time
+	run            func(string, ...string) error
+	duration       time.Duration
+	onstart        []func(string)
+	onerror        []func(string, string, error)
+	collector      MetricCollector
+	traceconverter func(string) error
+	memnogc        bool
+	minallocsize   int64
+	scopedlabels   []string
+	memlimit       uint64
+	intest         bool
+	goroutinedump  bool
+	stderr         io.Writer
+	mergepath      string
+	dryrun         bool
+	namer          func(string) string
+	outputdirs     map[string]string
+	sequence       bool
+	manifestpath   string
+	discardempty   bool
+	fsync          bool
+	deterministic  bool
+	configdump     bool
+	schemes        map[string]func(*url.URL) (io.WriteCloser, error)
+	snapinterval   time.Duration
+	interval       time.Duration
+	warmup         time.Duration
+	warming        *warmup
+	ondemand       []ondemandbinding
+	memstatslog    time.Duration
+	rotatebytes    int64
+	rotatekeep     int
+	tracesplit     time.Duration
+	tracelimit     int64
+	methodorder    []string
+	strict         bool
+	rundir         bool
+	recordargs     bool
+	redactarg      func(string) string
 
-	running []method
+	flags        map[method][]*flag.Flag
+	sessionflags []*flag.Flag
+	flagsets     []*flag.FlagSet
+	mu           sync.Mutex
+	running      []method
+	archive      *archive
+	timer        *time.Timer
+	ctx          context.Context
+	ctxdone      chan struct{}
+	done         chan struct{}
+	starterr     error
+	optionerrs   []error
+	started      time.Time
+	manifest     *manifest
+	snapshotter  *poller
+	snapseq      map[method]int
+	snapseqmu    sync.Mutex
+	guard        *poller
+	memstats     *poller
+	labelled     bool
+	checkpoints  map[string]*pprofile.Profile
+	written      map[string]int64
+	writtenmu    sync.Mutex
+	hook         *hook
+	runpath      string
+	demandhook   *ondemand
 }
 
 // New creates a new profiling session configured with the given options.
 func New(options ...func(*Profile)) *Profile {
 	p := &Profile{
-		log: log.Printf,
+		logf:       log.Printf,
+		verbosity:  1,
+		flags:      map[method][]*flag.Flag{},
+		fs:         osfs{},
+		exit:       os.Exit,
+		notify:     signal.Notify,
+		stopnotify: signal.Stop,
+		stderr:     os.Stderr,
+		clock:      time.Now,
+		run:        startcommand,
 	}
 	p.Configure(options...)
 	return p
@@ -35,6 +137,24 @@ func Start(options ...func(*Profile)) *Profile {
 	return New(options...).Start()
 }
 
+// StartContext starts a new profiling session with the given options, bound to
+// ctx. See the StartContext method.
+func StartContext(ctx context.Context, options ...func(*Profile)) *Profile {
+	return New(options...).StartContext(ctx)
+}
+
+// Func profiles a single call to fn with the given options, starting profiling
+// before the call and stopping it after, even if fn panics, as with Run. If no
+// profiles are configured, the cpu and memory profiles are enabled. Returns the
+// first error encountered stopping profiling, as with Close.
+func Func(fn func(), options ...func(*Profile)) error {
+	p := New(options...)
+	if len(p.methods) == 0 && !p.nodefault {
+		p.Configure(CPUProfile, MemProfile)
+	}
+	return p.runfunc(fn)
+}
+
 // Configure applies the given options to this profiling session.
 func (p *Profile) Configure(options ...func(*Profile)) {
 	for _, option := range options {
@@ -42,10 +162,33 @@ func (p *Profile) Configure(options ...func(*Profile)) {
 	}
 }
 
+// Reset clears the configured profiles, and their flags and state from
+// previous runs, so the session can be configured afresh with Configure.
+// Session-wide options, such as the logger and output directory, are retained.
+// This allows one session to profile different phases of a program with
+// different profiles. Returns an error if profiling is running.
+func (p *Profile) Reset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.running) > 0 {
+		return errors.New("profiling is running: stop before reset")
+	}
+
+	p.methods = nil
+	p.optionerrs = nil
+	p.flags = map[method][]*flag.Flag{}
+	p.flagsets = nil
+	p.checkpoints = nil
+	p.resetwritten()
+
+	return nil
+}
+
 // WithLogger configures informational messages to be logged to the given
 // logger. Defaults to the standard library global logger.
 func WithLogger(l *log.Logger) func(p *Profile) {
-	return func(p *Profile) { p.log = l.Printf }
+	return func(p *Profile) { p.logf = l.Printf }
 }
 
 // Quiet suppresses logging.
@@ -53,112 +196,838 @@ func Quiet(p *Profile) {
 	p.Configure(WithLogger(log.New(ioutil.Discard, "", 0)))
 }
 
+// WithQuietMethods suppresses the informational messages logged when the named
+// profiles start and stop, for example "trace profile: started", while
+// leaving messages for other profiles. Errors are still logged.
+func WithQuietMethods(names ...string) func(*Profile) {
+	return func(p *Profile) {
+		if p.quietmethods == nil {
+			p.quietmethods = map[string]bool{}
+		}
+		for _, name := range names {
+			p.quietmethods[name] = true
+		}
+	}
+}
+
+// WithVerbosity configures the level of logging. Level 0 logs errors only,
+// level 1 additionally logs informational messages such as profiles starting
+// and stopping, and level 2 logs debugging information such as the
+// configuration of each profile. Defaults to 1.
+func WithVerbosity(level int) func(*Profile) {
+	return func(p *Profile) { p.verbosity = level }
+}
+
+// WithName configures a name for the profiling session, which prefixes all
+// log messages. For example, with name "ingest" messages are logged as
+// "[ingest] cpu profile: started". This distinguishes concurrent sessions in
+// one process. The name is also recorded in the manifest, if configured.
+func WithName(name string) func(*Profile) {
+	return func(p *Profile) { p.name = name }
+}
+
+// WithID configures an identifier for the profiling session, such as the ID
+// of a distributed trace, to correlate profiles with other records. The ID is
+// included in log messages, for example "[id=4bf92f35] cpu profile: started",
+// and recorded in the manifest, if configured. Output filenames also include
+// the ID if configured with WithIDFilenames.
+func WithID(id string) func(*Profile) {
+	return func(p *Profile) { p.id = id }
+}
+
+// WithIDFilenames configures output filenames to include the session ID
+// configured with WithID, before the extension. For example, the cpu profile
+// may be written to cpu-4bf92f35.pprof. The ID must be valid in a filename.
+func WithIDFilenames() func(*Profile) {
+	return func(p *Profile) { p.idfilenames = true }
+}
+
+// log logs an error or warning message.
+func (p *Profile) log(format string, args ...interface{}) {
+	var prefix string
+	switch {
+	case p.name != "" && p.id != "":
+		prefix = p.name + " id=" + p.id
+	case p.name != "":
+		prefix = p.name
+	case p.id != "":
+		prefix = "id=" + p.id
+	default:
+		p.logf(format, args...)
+		return
+	}
+	p.logf("[%s] "+format, append([]interface{}{prefix}, args...)...)
+}
+
+// info logs an informational message.
+func (p *Profile) info(format string, args ...interface{}) {
+	if p.verbosity >= 1 {
+		p.log(format, args...)
+	}
+}
+
+// methodinfo logs an informational message about method m, unless it has been
+// quietened with WithQuietMethods.
+func (p *Profile) methodinfo(m method, format string, args ...interface{}) {
+	if !p.quietmethods[m.Name()] {
+		p.info(format, args...)
+	}
+}
+
+// debug logs a debugging message.
+func (p *Profile) debug(format string, args ...interface{}) {
+	if p.verbosity >= 2 {
+		p.log(format, args...)
+	}
+}
+
 // NoShutdownHook controls whether the profiling session should shutdown on
 // interrupt.  Programs with more sophisticated signal handling should use this
 // option to disable the default shutdown handler, and ensure the profile Stop()
 // method is called during shutdown.
 func NoShutdownHook(p *Profile) { p.noshutdownhook = true }
 
+// WithNoDefault prevents the cpu profile from being enabled when no profiles
+// are configured. By default, a session without any profiles enables the cpu
+// profile.
+func WithNoDefault() func(*Profile) {
+	return func(p *Profile) { p.nodefault = true }
+}
+
+// WithDryRun configures the session to log the profiles that would be started,
+// and their output files, without starting them. No runtime settings are
+// changed and no files are written. This is useful to verify configuration.
+func WithDryRun() func(*Profile) {
+	return func(p *Profile) { p.dryrun = true }
+}
+
+// InTest configures the session for use inside a test binary. Registering a
+// flag that is already defined, for example by the testing package, would
+// otherwise panic. With InTest such flags are skipped by SetFlags, leaving the
+// test harness in control of them. Profiles are written relative to the
+// working directory, which go test sets to the package directory.
+func InTest(p *Profile) { p.intest = true }
+
+// WithFlagPrefix configures a prefix for flags registered by SetFlags. For
+// example, with prefix "prof." the cpu profile is configured with the
+// -prof.cpuprofile flag. This avoids collisions with flags of the same name
+// registered by other packages, such as testing.
+func WithFlagPrefix(prefix string) func(*Profile) {
+	return func(p *Profile) { p.flagprefix = prefix }
+}
+
+// WithFlagNames configures the names of the flags that set output files of
+// profiles, keyed by profile name. For example, mapping "cpu" to "cpu-profile"
+// configures the cpu profile with the -cpu-profile flag. Profiles without an
+// entry keep their default flag names. Names are also used as keys by
+// configuration sources.
+func WithFlagNames(names map[string]string) func(*Profile) {
+	return func(p *Profile) {
+		if p.flagnames == nil {
+			p.flagnames = map[string]string{}
+		}
+		for name, flag := range names {
+			p.flagnames[name] = flag
+		}
+	}
+}
+
+// applyflagnames sets the configured output file flag names.
+func (p *Profile) applyflagnames() {
+	for _, m := range p.methods {
+		f, ok := m.(fileflagger)
+		if name := p.flagnames[m.Name()]; ok && name != "" {
+			f.setfileflagname(name)
+		}
+	}
+}
+
+// WithClock configures the source of the current time, used for timestamped
+// filenames and the logged profiling duration. Defaults to time.Now. This is
+// intended for tests and reproducible builds that require deterministic output.
+func WithClock(now func() time.Time) func(*Profile) {
+	return func(p *Profile) { p.clock = now }
+}
+
+// WithOnStart registers a function to be called with the name of each enabled
+// profile immediately before it is started. Functions are called synchronously,
+// in the order they were registered.
+func WithOnStart(fn func(name string)) func(*Profile) {
+	return func(p *Profile) { p.onstart = append(p.onstart, fn) }
+}
+
+// WithErrorHandler registers a function to be called when a profile fails to
+// start or stop, with the profile name, the phase "start" or "stop", and the
+// error. This allows errors to be monitored, in addition to being logged.
+func WithErrorHandler(fn func(name, phase string, err error)) func(*Profile) {
+	return func(p *Profile) { p.onerror = append(p.onerror, fn) }
+}
+
+// failed records an error in the given phase of method m.
+func (p *Profile) failed(m method, phase string, err error) {
+	p.manifest.error(m, err)
+	for _, fn := range p.onerror {
+		fn(m.Name(), phase, err)
+	}
+}
+
+// If applies the given option only when cond is true, otherwise it applies
+// Disabled. This allows profiling to be enabled conditionally while keeping
+// uniform Start and Stop calls.
+func If(cond bool, option func(*Profile)) func(*Profile) {
+	return func(p *Profile) {
+		if cond {
+			p.Configure(option)
+		} else {
+			p.Configure(Disabled)
+		}
+	}
+}
+
 // ConfigEnvVar specifies an environment variable to configure profiles from.
+// The variable is read when profiling is started. Flags registered with
+// SetFlags and explicitly set on the command line take precedence over the
+// environment variable. Whitespace and empty pairs are ignored, and invalid
+// pairs are logged and skipped. The value "help" lists valid keys and exits.
+// Equivalent to ConfigSources(EnvVar(key)).
 func ConfigEnvVar(key string) func(*Profile) {
-	return func(p *Profile) { p.envvar = key }
+	return ConfigSources(EnvVar(key))
 }
 
 func (p *Profile) addmethod(m method) {
 	p.methods = append(p.methods, m)
 }
 
+// method returns the configured method with the given name, or nil if there is
+// none.
+func (p *Profile) method(name string) method {
+	for _, m := range p.methods {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
+
 func (p *Profile) setdefaults() {
-	if len(p.methods) == 0 {
+	if len(p.methods) == 0 && !p.nodefault {
 		p.Configure(CPUProfile)
 	}
+	p.applynamer()
+	p.applyflagnames()
 }
 
 // SetFlags registers flags to configure this profiling session.  This should be
 // called after all options have been applied.
 func (p *Profile) SetFlags(f *flag.FlagSet) {
+	p.setflags(f, p.flagprefix)
+	p.flagsets = append(p.flagsets, f)
+}
+
+// setflags registers flags for the session and all methods, with names
+// prefixed by prefix.
+func (p *Profile) setflags(f *flag.FlagSet, prefix string) {
 	p.setdefaults()
+	flags := p.profileflags()
 	for _, m := range p.methods {
-		m.SetFlags(f)
+		flags = append(flags, p.methodflags(m)...)
+	}
+	for _, opt := range flags {
+		name := prefix + opt.Name
+		if p.intest && f.Lookup(name) != nil {
+			p.debug("flag -%s already defined: skipping", name)
+			continue
+		}
+		f.Var(opt.Value, name, opt.Usage)
 	}
 }
 
+// profileflags returns flags that configure the session as a whole, rather
+// than an individual method. As with methodflags, flags are registered once
+// and the same flags returned on subsequent calls.
+func (p *Profile) profileflags() []*flag.Flag {
+	if p.sessionflags != nil {
+		return p.sessionflags
+	}
+
+	scratch := flag.NewFlagSet("", flag.ContinueOnError)
+	scratch.DurationVar(&p.duration, "profileduration", p.duration, "stop profiling after `duration`")
+	flags := []*flag.Flag{}
+	scratch.VisitAll(func(opt *flag.Flag) {
+		flags = append(flags, opt)
+	})
+	p.sessionflags = flags
+
+	return flags
+}
+
+// methodflags returns the flags for method m. On first call flags are
+// registered on a scratch flagset, which resets the method's configuration to
+// flag defaults. Subsequent calls return the same flags.
+func (p *Profile) methodflags(m method) []*flag.Flag {
+	if flags, ok := p.flags[m]; ok {
+		return flags
+	}
+
+	scratch := flag.NewFlagSet("", flag.ContinueOnError)
+	m.SetFlags(scratch)
+	flags := []*flag.Flag{}
+	scratch.VisitAll(func(opt *flag.Flag) {
+		flags = append(flags, opt)
+	})
+	p.flags[m] = flags
+
+	return flags
+}
+
+// EnabledMethods returns the names of profiling methods that will run when the
+// session is started. This should be called after flags have been parsed.
+func (p *Profile) EnabledMethods() []string {
+	p.setdefaults()
+	var names []string
+	for _, m := range p.methods {
+		if m.Enabled() {
+			names = append(names, m.Name())
+		}
+	}
+	return names
+}
+
+// MethodInfo describes a configured profiling method.
+type MethodInfo struct {
+	// Name of the profiling method, for example "cpu".
+	Name string
+
+	// Filename is the output file. Empty if no output file is configured.
+	Filename string
+
+	// Enabled reports whether the method will run when the session is started.
+	Enabled bool
+}
+
+// Describe returns information about all configured profiling methods, in the
+// order they were configured. As with EnabledMethods, this should be called
+// after flags have been parsed.
+func (p *Profile) Describe() []MethodInfo {
+	p.setdefaults()
+	info := make([]MethodInfo, 0, len(p.methods))
+	for _, m := range p.methods {
+		info = append(info, MethodInfo{
+			Name:     m.Name(),
+			Filename: m.Filename(),
+			Enabled:  m.Enabled(),
+		})
+	}
+	return info
+}
+
 // config configures profiles based on a GODEBUG-like configuration string.
+// Flags explicitly set on the command line take precedence over values in the
+// configuration string.
 func (p *Profile) config(cfg string) {
-	// Convert config string into equivalent command-line arguments and parse them.
-	args := []string{}
-	for _, arg := range strings.Split(cfg, ",") {
-		args = append(args, "-"+arg)
-	}
+	// Record values explicitly set on the command line.
+	explicit := p.explicitflags()
 
 	// Register flags on a custom flagset. Register custom usage function that
 	// will output flags in a format closer to the expected format of the
 	// configuration string.
-	f := flag.NewFlagSet("", flag.ExitOnError)
-	p.SetFlags(f)
+	f := flag.NewFlagSet("", flag.ContinueOnError)
+	p.setflags(f, "")
 
-	f.Usage = func() {
+	usage := func() {
 		f.VisitAll(func(opt *flag.Flag) {
 			value, usage := flag.UnquoteUsage(opt)
-			fmt.Fprintf(f.Output(), "%s=%s\n\t%s\n", opt.Name, value, usage)
+			fmt.Fprintf(p.stderr, "%s=%s\n\t%s\n", opt.Name, value, usage)
 		})
 	}
 
-	// Parse. Discard error because ExitOnError ensures it's handled internally.
-	_ = f.Parse(args)
+	// Apply each key-value pair, ignoring surrounding whitespace and empty
+	// pairs. Invalid pairs are reported and skipped.
+	for _, setting := range strings.Split(cfg, ",") {
+		setting = strings.TrimSpace(setting)
+		switch setting {
+		case "":
+			continue
+		case "help", "h":
+			usage()
+			p.exit(0)
+			return
+		}
+
+		i := strings.Index(setting, "=")
+		if i < 0 {
+			p.log("config: invalid setting %q: expected key=value", setting)
+			p.starterror(fmt.Errorf("config: invalid setting %q", setting))
+			continue
+		}
+		key, value := strings.TrimSpace(setting[:i]), strings.TrimSpace(setting[i+1:])
+
+		if f.Lookup(key) == nil {
+			p.log("config: unknown key %q: use \"help\" to list valid keys", key)
+			p.starterror(fmt.Errorf("config: unknown key %q", key))
+			continue
+		}
+		if err := f.Set(key, value); err != nil {
+			p.log("config: invalid value %q for %s: %v", value, key, err)
+			p.starterror(fmt.Errorf("config: invalid value %q for %s: %w", value, key, err))
+		}
+	}
+
+	// Restore command-line values.
+	for v, s := range explicit {
+		_ = v.Set(s) // value was previously accepted by Set
+	}
+}
+
+// explicitflags returns the current string representation of session and
+// method flag values that have been explicitly set on flagsets registered with
+// SetFlags.
+func (p *Profile) explicitflags() map[flag.Value]string {
+	// Collect the values belonging to the session and methods.
+	values := map[flag.Value]bool{}
+	for _, opt := range p.sessionflags {
+		values[opt.Value] = true
+	}
+	for _, flags := range p.flags {
+		for _, opt := range flags {
+			values[opt.Value] = true
+		}
+	}
+
+	// Visit flags set on registered flagsets.
+	explicit := map[flag.Value]string{}
+	for _, f := range p.flagsets {
+		f.Visit(func(opt *flag.Flag) {
+			if values[opt.Value] {
+				explicit[opt.Value] = opt.Value.String()
+			}
+		})
+	}
+
+	return explicit
+}
+
+// WithDuration configures profiling to stop automatically after d, as with
+// the -profileduration flag. Use Wait to block until profiling has stopped.
+func WithDuration(d time.Duration) func(*Profile) {
+	return func(p *Profile) { p.duration = d }
+}
+
+// StartContext starts profiling, stopping automatically when ctx is done. For
+// example, with a context from context.WithTimeout profiling stops at the
+// deadline and output is written. Profiling may still be stopped earlier with
+// Stop.
+func (p *Profile) StartContext(ctx context.Context) *Profile {
+	p.ctx = ctx
+	return p.Start()
 }
 
 // Start profiling.
 func (p *Profile) Start() *Profile {
+	if err := p.start(); err != nil && p.strict {
+		panic(err)
+	}
+	return p
+}
+
+// WithStrict configures profiling to fail fast on misconfiguration, rather
+// than logging errors and continuing. In strict mode, an invalid configuration
+// setting or a profile that fails to start aborts profiling: any profiles
+// already started are stopped, and the error is returned by TryStart. Start
+// panics instead. This ensures misconfigured profiling is noticed in automated
+// runs, such as CI.
+func WithStrict() func(*Profile) {
+	return func(p *Profile) { p.strict = true }
+}
+
+// TryStart starts profiling, returning the first error encountered. Errors are
+// also logged, as with Start. Unless configured with WithStrict, profiles that
+// started successfully continue to run regardless of errors, and Stop must
+// still be called.
+func (p *Profile) TryStart() error {
+	return p.start()
+}
+
+// starterror records err as an error starting profiling. Only the first error
+// is recorded.
+func (p *Profile) starterror(err error) {
+	if p.starterr == nil {
+		p.starterr = err
+	}
+}
+
+// abort stops profiling after a start error in strict mode.
+func (p *Profile) abort() error {
+	p.log("strict: aborting: %v", p.starterr)
+	_ = p.stop() // errors are logged
+	return p.starterr
+}
+
+// start profiling, returning the first error.
+func (p *Profile) start() error {
 	// Set defaults.
 	p.setdefaults()
+	p.starterr = nil
 
-	// Optionally configure via environment variable.
-	if p.envvar != "" {
-		p.config(os.Getenv(p.envvar))
+	// Report invalid options.
+	for _, err := range p.optionerrs {
+		p.log("%v", err)
+		p.starterror(err)
 	}
 
-	// Start methods.
-	for _, m := range p.methods {
+	// Record that a session is in progress, for Wait.
+	p.mu.Lock()
+	p.done = make(chan struct{})
+	p.mu.Unlock()
+
+	// Apply configuration sources.
+	for _, source := range p.sources {
+		if err := source(); err != nil {
+			p.log("config: error reading: %v", err)
+			p.starterror(fmt.Errorf("config: %w", err))
+		}
+	}
+
+	// Resolve the start order, so that invalid orders are reported before any
+	// profile is started.
+	ordered := p.startorder()
+	if p.strict && p.starterr != nil {
+		return p.abort()
+	}
+
+	if p.configdump {
+		p.dumpconfig()
+	}
+
+	if args := p.args(); args != nil {
+		p.info("args: %q", args)
+	}
+
+	p.makerundir()
+
+	// Buffer output for the archive, if configured.
+	if p.archivepath != "" && !p.dryrun {
+		p.archive = &archive{}
+	}
+
+	// Start methods, in order.
+	p.started = p.clock()
+	p.resetwritten()
+	p.resetsnapshotseq()
+	if p.manifestpath != "" && !p.dryrun {
+		p.manifest = p.newmanifest(p.started)
+	}
+	var warming []method
+	for _, m := range ordered {
 		if !m.Enabled() {
+			if e, ok := m.(explainer); ok {
+				if reason := e.disabledreason(); reason != "" {
+					p.log("%s profile: not started: %s", m.Name(), reason)
+				}
+			}
+			continue
+		}
+
+		p.nextsequence(m)
+		p.debugconfig(m)
+
+		if p.dryrun {
+			p.log("dry run: %s profile: would write %s", m.Name(), p.methodpath(m, m.Filename()))
 			continue
 		}
 
-		if err := m.Start(); err != nil {
+		if err := p.checkwritable(m, m.Filename()); err != nil {
 			p.log("%s profile: error starting: %v", m.Name(), err)
+			p.failed(m, "start", err)
+			p.starterror(fmt.Errorf("%s profile: %w", m.Name(), err))
 			continue
 		}
 
-		p.log("%s profile: started", m.Name())
-		p.running = append(p.running, m)
+		if p.warmup > 0 && warms(m) {
+			p.methodinfo(m, "%s profile: starting after warmup of %v", m.Name(), p.warmup)
+			warming = append(warming, m)
+			continue
+		}
+
+		if err := p.startmethod(m); err != nil {
+			p.starterror(err)
+		}
 	}
 
+	p.startsnapshots()
+	p.startguard()
+	p.startondemand()
+	if p.strict && p.starterr != nil {
+		return p.abort()
+	}
+	p.startmemstats()
+
 	// Shutdown hook.
 	if !p.noshutdownhook {
-		go func() {
-			c := make(chan os.Signal, 1)
-			signal.Notify(c, os.Interrupt)
-			s := <-c
+		p.starthook()
+	}
 
-			p.log("caught %v: stopping profiles", s)
+	// Stop automatically after the configured duration.
+	if p.duration > 0 {
+		d := p.duration
+		p.mu.Lock()
+		p.timer = time.AfterFunc(d, func() {
+			p.info("profile duration %v elapsed: stopping profiles", d)
 			p.Stop()
+		})
+		p.mu.Unlock()
+	}
 
-			os.Exit(0)
-		}()
+	// Stop automatically when the context is done.
+	if p.ctx != nil {
+		p.watchcontext()
 	}
 
-	return p
+	// Start profiles delayed by the warmup.
+	if len(warming) > 0 {
+		p.startwarmup(warming)
+	}
+
+	// Label the calling goroutine, if configured. This is done last, so that
+	// background goroutines started above don't inherit the labels.
+	if !p.dryrun {
+		p.setscopedlabels()
+	}
+
+	return p.starterr
+}
+
+// startmethod starts method m and adds it to the running methods. Failures are
+// logged and reported to error handlers, and returned.
+func (p *Profile) startmethod(m method) error {
+	for _, fn := range p.onstart {
+		fn(m.Name())
+	}
+
+	p.manifest.started(m)
+	if err := m.Start(p); err != nil {
+		p.log("%s profile: error starting: %v", m.Name(), err)
+		p.failed(m, "start", err)
+		return fmt.Errorf("%s profile: %w", m.Name(), err)
+	}
+
+	p.logstarted(m)
+	p.running = append(p.running, m)
+	p.setrunning(m, true)
+	return nil
+}
+
+// stopmethod stops method m. Failures are logged and reported to error
+// handlers, and returned. The caller is responsible for removing m from the
+// running methods.
+func (p *Profile) stopmethod(m method) error {
+	defer p.setrunning(m, false)
+	if err := m.Stop(p); err != nil {
+		p.log("%s profile: error stopping: %v", m.Name(), err)
+		p.failed(m, "stop", err)
+		return fmt.Errorf("%s profile: %w", m.Name(), err)
+	}
+	p.methodinfo(m, "%s profile: stopped", m.Name())
+	return nil
+}
+
+// logstarted logs that method m has started, with the output it is writing if
+// any.
+func (p *Profile) logstarted(m method) {
+	filename := m.Filename()
+	if s, ok := m.(streamer); ok {
+		filename = s.currentfile()
+	}
+	if filename == "" {
+		p.methodinfo(m, "%s profile: started", m.Name())
+		return
+	}
+	p.methodinfo(m, "%s profile: started (%s)", m.Name(), p.outputpath(m, filename))
+}
+
+// watchcontext stops profiling when the context is done, in the background.
+// The watcher exits when profiling is stopped.
+func (p *Profile) watchcontext() {
+	ctx := p.ctx
+	done := make(chan struct{})
+
+	p.mu.Lock()
+	p.ctxdone = done
+	p.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.info("context done: %v: stopping profiles", ctx.Err())
+			p.Stop()
+		case <-done:
+		}
+	}()
+}
+
+// debugconfig logs the configuration of method m.
+func (p *Profile) debugconfig(m method) {
+	p.debug("%s profile: output file %s", m.Name(), m.Filename())
+	for _, opt := range p.flags[m] {
+		p.debug("%s profile: flag %s=%s", m.Name(), opt.Name, opt.Value)
+	}
+}
+
+// WithConfigDump configures the effective profiling configuration to be logged
+// when profiling is started, after configuration sources and flags have been
+// applied. Each profile is logged with its output file, or as disabled,
+// followed by the values of any flags registered for it. For example, "config:
+// cpu: cpu.pprof". This records exactly how a run was profiled.
+func WithConfigDump() func(*Profile) {
+	return func(p *Profile) { p.configdump = true }
+}
+
+// dumpconfig logs the configuration of all methods.
+func (p *Profile) dumpconfig() {
+	for _, m := range p.methods {
+		if !m.Enabled() {
+			p.log("config: %s: disabled", m.Name())
+			continue
+		}
+		p.log("config: %s: %s", m.Name(), m.Filename())
+
+		f, _ := m.(fileflagger)
+		for _, opt := range p.flags[m] {
+			if f == nil || opt.Name != f.fileflagname() {
+				p.log("config: %s: %s=%s", m.Name(), opt.Name, opt.Value)
+			}
+		}
+	}
+	if p.duration > 0 {
+		p.log("config: duration: %v", p.duration)
+	}
+}
+
+// Run starts profiling, calls fn and then stops profiling. Profiles are stopped
+// even if fn panics, in which case the panic is propagated after profiles
+// have been flushed.
+//
+// Note that a deferred Stop call also runs when its goroutine panics, so Run is
+// equivalent to a deferred Stop. However, panics in other goroutines terminate
+// the program without running deferred functions, in which case streaming
+// profiles such as the cpu profile and execution trace will be truncated.
+func (p *Profile) Run(fn func()) {
+	_ = p.runfunc(fn) // errors are logged
+}
+
+// runfunc implements Run, returning the first error encountered stopping
+// profiles.
+func (p *Profile) runfunc(fn func()) error {
+	p.Start()
+	defer func() {
+		if r := recover(); r != nil {
+			p.info("panic: stopping profiles")
+			p.Stop()
+			panic(r)
+		}
+	}()
+	fn()
+	return p.stop()
 }
 
 // Stop profiling.
 func (p *Profile) Stop() {
-	for _, m := range p.running {
-		if err := m.Stop(); err != nil {
-			p.log("%s profile: error stopping: %v", m.Name(), err)
-		} else {
-			p.log("%s profile: stopped", m.Name())
+	_ = p.stop() // errors are logged
+}
+
+// Close stops profiling, returning the first error encountered. Errors are
+// also logged, as with Stop. Close allows a profiling session to be used as an
+// io.Closer.
+func (p *Profile) Close() error {
+	return p.stop()
+}
+
+// Wait blocks until profiling has stopped, whether by Stop or automatically,
+// for example after the configured duration or when the context passed to
+// StartContext is done. Returns immediately if profiling is not running.
+func (p *Profile) Wait() {
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// stop profiling, returning the first error. Only the first call after Start
+// has any effect.
+func (p *Profile) stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Release waiters once stopped.
+	if done := p.done; done != nil {
+		p.done = nil
+		defer close(done)
+	}
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	if p.ctxdone != nil {
+		close(p.ctxdone)
+		p.ctxdone = nil
+	}
+
+	werr := p.stopwarmup()
+	p.stopsnapshots()
+	p.stopguard()
+	p.stopondemand()
+	p.stopmemstats()
+	p.stophook()
+	p.clearscopedlabels()
+
+	if len(p.running) == 0 && p.archive == nil && p.manifest == nil {
+		return werr
+	}
+
+	// Stop methods in the reverse order they were started. Failures to start
+	// after the warmup are reported first, since they happened first.
+	first := werr
+	for i := len(p.running) - 1; i >= 0; i-- {
+		if err := p.stopmethod(p.running[i]); err != nil && first == nil {
+			first = err
 		}
 	}
 
 	p.running = nil
+
+	p.info("profiling stopped after %v", p.clock().Sub(p.started))
+
+	// Write archive.
+	if p.archive != nil {
+		if err := p.writearchive(); err != nil {
+			p.log("archive: error writing: %v", err)
+			if first == nil {
+				first = fmt.Errorf("archive: %w", err)
+			}
+		}
+		p.archive = nil
+	}
+
+	// Write manifest.
+	if p.manifest != nil {
+		if err := p.writemanifest(); err != nil {
+			p.log("manifest: error writing: %v", err)
+			if first == nil {
+				first = fmt.Errorf("manifest: %w", err)
+			}
+		}
+		p.manifest = nil
+	}
+
+	// Open in browser.
+	if p.openbrowser != "" {
+		p.browse()
+	}
+
+	return first
 }
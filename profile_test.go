@@ -1,15 +1,27 @@
 package profile_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"runtime/debug"
 	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	pprofile "github.com/google/pprof/profile"
 	"github.com/mmcloughlin/profile"
 )
 
@@ -143,23 +155,1106 @@ func TestFlagsConfiguration(t *testing.T) {
 	}
 }
 
+func TestFlagPrefix(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.CPUProfile,
+		profile.WithFlagPrefix("prof."),
+		profile.WithLogger(Logger(t)),
+	)
+
+	// Register flags alongside a conflicting unprefixed flag.
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	f.String("cpuprofile", "", "conflicting flag")
+	p.SetFlags(f)
+
+	if err := f.Parse([]string{"-prof.cpuprofile=cpu.out"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	AssertDirContains(t, dir, []string{"cpu.out"})
+}
+
+func TestFlagNames(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithFlagNames(map[string]string{"cpu": "cpu-profile"}),
+		profile.WithLogger(Logger(t)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if f.Lookup("cpuprofile") != nil {
+		t.Fatal("default flag name should not be registered")
+	}
+
+	if err := f.Parse([]string{"-cpu-profile=cpu.out", "-memprofile=mem.out"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	AssertDirContains(t, dir, []string{"cpu.out", "mem.out"})
+}
+
+func TestInTest(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Simulate the flags registered by the testing package.
+	f := flag.NewFlagSet("profile.test", flag.ContinueOnError)
+	testcpu := f.String("test.cpuprofile", "", "write a cpu profile to `file`")
+
+	p := profile.New(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithFlagPrefix("test."),
+		profile.InTest,
+		profile.WithLogger(Logger(t)),
+	)
+	p.SetFlags(f)
+
+	if err := f.Parse([]string{"-test.cpuprofile=harness.cpu", "-test.memprofile=mem.out"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if *testcpu != "harness.cpu" {
+		t.Fatalf("expected conflicting flag to be left to the test harness")
+	}
+
+	p.Start().Stop()
+
+	AssertDirContains(t, dir, []string{"mem.out"})
+}
+
+func TestNoDefault(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(profile.WithNoDefault(), profile.WithLogger(Logger(t)))
+	p.Start().Stop()
+
+	if enabled := p.EnabledMethods(); len(enabled) != 0 {
+		t.Fatalf("expected no enabled methods; got %v", enabled)
+	}
+	AssertDirContains(t, dir, nil)
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.CPUProfile,
+		profile.WithMemProfileFile("mem.out"),
+		profile.WithArchive("profiles.zip"),
+		profile.WithDryRun(),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	t.Log(buf.String())
+	for _, expect := range []string{
+		"dry run: cpu profile: would write cpu.pprof",
+		"dry run: mem profile: would write mem.out",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected %q in output", expect)
+		}
+	}
+	if strings.Contains(buf.String(), "started") {
+		t.Error("unexpected profile started in dry run")
+	}
+	AssertDirContains(t, dir, nil)
+}
+
+func TestStartStopOrder(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Options []func(*profile.Profile)
+	}{
+		{Name: "cpu_first", Options: []func(*profile.Profile){profile.CPUProfile, profile.TraceProfile, profile.MemProfile}},
+		{Name: "trace_first", Options: []func(*profile.Profile){profile.TraceProfile, profile.MemProfile, profile.CPUProfile}},
+	}
+	for _, c := range cases {
+		c := c // scopelint
+		t.Run(c.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			Chdir(t, dir)
+
+			buf := new(bytes.Buffer)
+			p := profile.New(c.Options...)
+			p.Configure(profile.WithLogger(log.New(buf, "", 0)), profile.WithClock(FixedClock()))
+			p.Start()
+			spin(100 * time.Millisecond)
+			p.Stop()
+
+			// Verify order.
+			expect := strings.Join([]string{
+				"mem profile: started (mem.pprof)",
+				CPUParallelismLog(),
+				"cpu profile: started (cpu.pprof)",
+				"trace profile: started (trace.out)",
+				"trace profile: stopped",
+				"cpu profile: stopped",
+				"mem profile: stopped",
+				"profiling stopped after 0s",
+			}, "\n") + "\n"
+			if buf.String() != expect {
+				t.Fatalf("got log output\n%s\nexpect\n%s", buf, expect)
+			}
+
+			// Verify outputs.
+			f, err := os.Open("cpu.pprof")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := pprofile.Parse(f); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := ioutil.ReadFile("trace.out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(b, []byte("go 1.")) {
+				t.Fatal("expected trace header")
+			}
+		})
+	}
+}
+
+func TestFunc(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	err := profile.Func(func() { spin(100 * time.Millisecond) }, profile.WithLogger(Logger(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AssertDirContains(t, dir, []string{"cpu.pprof", "mem.pprof"})
+
+	f, err := os.Open("cpu.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := pprofile.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) == 0 {
+		t.Fatal("expected cpu profile samples")
+	}
+}
+
+func TestFuncPanic(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("expected panic to propagate; got %v", r)
+			}
+		}()
+		_ = profile.Func(func() { panic("boom") }, profile.WithLogger(Logger(t)))
+	}()
+
+	// Profiling should have stopped, so another session can start.
+	AssertDirContains(t, dir, []string{"cpu.pprof", "mem.pprof"})
+	if err := profile.Func(func() {}, profile.WithLogger(Logger(t))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	p := profile.New(profile.CPUProfile, profile.WithClock(FixedClock()), profile.WithLogger(log.New(buf, "", 0)))
+
+	// First session.
+	p.Start()
+	if err := p.Reset(); err == nil {
+		t.Fatal("expected error resetting while running")
+	}
+	p.Stop()
+
+	// Reconfigure for a second session.
+	if err := p.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	p.Configure(profile.WithMemProfileFile("phase2.pprof"))
+	p.Start().Stop()
+
+	expect := strings.Join([]string{
+		CPUParallelismLog(),
+		"cpu profile: started (cpu.pprof)",
+		"cpu profile: stopped",
+		"profiling stopped after 0s",
+		"mem profile: started (phase2.pprof)",
+		"mem profile: stopped",
+		"profiling stopped after 0s",
+	}, "\n") + "\n"
+	if buf.String() != expect {
+		t.Fatalf("got log output\n%s\nexpect\n%s", buf, expect)
+	}
+	AssertDirContains(t, dir, []string{"cpu.pprof", "phase2.pprof"})
+}
+
+func TestWithMethodOrder(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.TraceProfile,
+		profile.MemProfile,
+		profile.WithMethodOrder("trace", "unknown", "cpu"),
+		profile.WithClock(FixedClock()),
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+	p.Stop()
+
+	expect := strings.Join([]string{
+		`order: unknown profile "unknown": ignoring`,
+		"trace profile: started (trace.out)",
+		CPUParallelismLog(),
+		"cpu profile: started (cpu.pprof)",
+		"mem profile: started (mem.pprof)",
+		"mem profile: stopped",
+		"cpu profile: stopped",
+		"trace profile: stopped",
+		"profiling stopped after 0s",
+	}, "\n") + "\n"
+	if buf.String() != expect {
+		t.Fatalf("got log output\n%s\nexpect\n%s", buf, expect)
+	}
+}
+
+func TestWithMethodOrderStrict(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.CPUProfile,
+		profile.WithMethodOrder("unknown", "cpu"),
+		profile.WithStrict(),
+		profile.WithLogger(Logger(t)),
+	)
+	err := p.TryStart()
+	if err == nil || !strings.Contains(err.Error(), `order: unknown profile "unknown"`) {
+		t.Fatalf("TryStart() = %v; expect unknown profile error", err)
+	}
+	AssertDirContains(t, dir, nil)
+}
+
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	var c io.Closer = profile.Start(profile.CPUProfile, profile.WithLogger(Logger(t)))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	AssertDirContains(t, dir, []string{"cpu.pprof"})
+}
+
+func TestProfileDuration(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Log to a channel so we can wait for profiling to stop.
+	lines := make(chan string, 16)
+	p := profile.New(
+		profile.CPUProfile,
+		profile.NoShutdownHook,
+		profile.WithLogger(log.New(LineWriter(lines), "", 0)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-cpuprofile=cpu.out", "-profileduration=50ms"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start()
+
+	// Wait for automatic stop.
+	timeout := time.After(10 * time.Second)
+	for stopped := false; !stopped; {
+		select {
+		case line := <-lines:
+			t.Log(line)
+			stopped = strings.Contains(line, "cpu profile: stopped")
+		case <-timeout:
+			t.Fatal("timeout waiting for profile to stop")
+		}
+	}
+
+	AssertDirContains(t, dir, []string{"cpu.out"})
+}
+
+func TestWait(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	d := 100 * time.Millisecond
+	start := time.Now()
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.WithDuration(d),
+		profile.NoShutdownHook,
+		profile.WithLogger(Logger(t)),
+	)
+	p.Wait()
+
+	if elapsed := time.Since(start); elapsed < d {
+		t.Fatalf("wait returned after %v; expect at least %v", elapsed, d)
+	}
+	AssertDirContains(t, dir, []string{"cpu.pprof"})
+
+	// Expect subsequent calls to return immediately.
+	p.Wait()
+}
+
+func TestStartContextDeadline(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Log to a channel so we can wait for profiling to stop.
+	lines := make(chan string, 16)
+	profile.StartContext(ctx,
+		profile.CPUProfile,
+		profile.NoShutdownHook,
+		profile.WithLogger(log.New(LineWriter(lines), "", 0)),
+	)
+
+	// Wait for automatic stop.
+	timeout := time.After(10 * time.Second)
+	for stopped := false; !stopped; {
+		select {
+		case line := <-lines:
+			t.Log(line)
+			stopped = strings.Contains(line, "cpu profile: stopped")
+		case <-timeout:
+			t.Fatal("timeout waiting for profile to stop")
+		}
+	}
+
+	AssertDirContains(t, dir, []string{"cpu.pprof"})
+}
+
+func TestStartContextStopBeforeDeadline(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	before := runtime.NumGoroutine()
+	profile.StartContext(ctx, profile.CPUProfile, profile.NoShutdownHook, profile.WithLogger(Logger(t))).Stop()
+
+	// Expect the context watcher to exit.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine leak: %d goroutines; expect %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	AssertDirContains(t, dir, []string{"cpu.pprof"})
+}
+
+func TestOnStart(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	var names []string
+	p := profile.New(
+		profile.AllProfiles,
+		profile.WithOnStart(func(name string) { names = append(names, name) }),
+		profile.WithLogger(Logger(t)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-trace=trace.out", "-cpuprofile=cpu.out", "-memprofile=mem.out"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	expect := []string{"mem", "cpu", "trace"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Fatalf("got on start calls %v; expect %v", names, expect)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	type failure struct {
+		Name, Phase string
+		Err         error
+	}
+	var failures []failure
+	handler := func(name, phase string, err error) {
+		failures = append(failures, failure{name, phase, err})
+	}
+
+	// Start fails since cpu profiling is already in use, and stop fails for
+	// write errors. Both output files are flaky, but the cpu profile is never
+	// written to.
+	first := profile.Start(profile.WithCPUProfileFile("first.pprof"), profile.WithLogger(Logger(t)))
+	defer first.Stop()
+
+	errwrite := errors.New("write failed")
+	fs := &FlakyFS{MemFS: NewMemFS(), Err: errwrite, Failures: 2}
+	profile.Start(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithFilesystem(fs),
+		profile.WithErrorHandler(handler),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+	first.Stop()
+
+	if len(failures) != 2 {
+		t.Fatalf("got %d failures; expect 2", len(failures))
+	}
+	for i, expect := range []struct{ Name, Phase string }{{"cpu", "start"}, {"mem", "stop"}} {
+		got := failures[i]
+		if got.Name != expect.Name || got.Phase != expect.Phase || got.Err == nil {
+			t.Errorf("failure %d: got %s %s %v; expect %s %s", i, got.Name, got.Phase, got.Err, expect.Name, expect.Phase)
+		}
+	}
+	if !errors.Is(failures[1].Err, errwrite) {
+		t.Errorf("expected write error; got %v", failures[1].Err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Start fails since cpu profiling is already in use.
+	first := profile.Start(profile.WithCPUProfileFile("first.pprof"), profile.WithLogger(Logger(t)))
+	defer first.Stop()
+
+	buf := new(bytes.Buffer)
+	p := profile.New(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.WithStrict(),
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+	err := p.TryStart()
+	p.Stop()
+	first.Stop()
+
+	t.Log(buf.String())
+	if err == nil || !strings.Contains(err.Error(), "cpu profile") {
+		t.Fatalf("expected cpu profile error; got %v", err)
+	}
+
+	// Expect the memory profile, started first, to have been stopped on abort.
+	if !strings.Contains(buf.String(), "strict: aborting") || !strings.Contains(buf.String(), "mem profile: stopped") {
+		t.Fatal("expected profiling to be aborted")
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	source := func() (string, error) { return "cpuprofile=cpu.pprof,unknown=1", nil }
+	p := profile.New(
+		profile.CPUProfile,
+		profile.ConfigSources(source),
+		profile.WithStrict(),
+		profile.WithLogger(Logger(t)),
+	)
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		}
+		AssertDirContains(t, dir, nil)
+	}()
+	p.Start()
+}
+
+func TestTryStartNotStrict(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	source := func() (string, error) { return "memprofile=mem.pprof,unknown=1", nil }
+	p := profile.New(
+		profile.MemProfile,
+		profile.ConfigSources(source),
+		profile.WithLogger(Logger(t)),
+	)
+	if err := p.TryStart(); err == nil {
+		t.Fatal("expected error")
+	}
+	p.Stop()
+
+	// Expect profiling to have continued regardless.
+	AssertDirContains(t, dir, []string{"mem.pprof"})
+}
+
+func TestRateDisabledWarning(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	p := profile.New(
+		profile.BlockProfile,
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-blockprofile=block.out", "-blockprofilerate=0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	t.Log(buf.String())
+	expect := `block profile: not started: output file "block.out" configured but rate 0 disables profiling`
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatal("expected warning about disabled rate")
+	}
+	AssertDirContains(t, dir, nil)
+}
+
+func TestCPUProfileRateUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	p := profile.New(
+		profile.CPUProfile,
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-cpuprofile=cpu.pprof", "-cpuprofilerate=500"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	t.Log(buf.String())
+	expect := "cpu profile: error starting: unsupported rate 500 Hz: pprof only supports the default of 100 Hz"
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatal("expected error about unsupported rate")
+	}
+	AssertDirContains(t, dir, nil)
+}
+
+func TestBlockProfilePeriod(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(profile.BlockProfile, profile.WithLogger(Logger(t)))
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	args := []string{"-blockprofile=block.out", "-blockprofilerate=0", "-blockprofileperiod=1us"}
+	if err := f.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start()
+	contend()
+	p.Stop()
+
+	r, err := os.Open("block.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	prof, err := pprofile.Parse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) == 0 {
+		t.Fatal("expected block profile samples")
+	}
+}
+
+func TestRunPanic(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.CPUProfile,
+		profile.TraceProfile,
+		profile.WithLogger(Logger(t)),
+	)
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("expected panic to propagate; got %v", r)
+			}
+		}()
+		p.Run(func() { panic("boom") })
+	}()
+
+	// Profiles should have been flushed.
+	AssertDirContains(t, dir, []string{"cpu.pprof", "trace.out"})
+
+	b, err := ioutil.ReadFile("trace.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("go 1.")) {
+		t.Fatal("trace does not have expected header")
+	}
+}
+
+func TestName(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	l := log.New(buf, "", 0)
+
+	ingest := profile.Start(
+		profile.WithMemProfileFile("ingest.mem"),
+		profile.WithName("ingest"),
+		profile.WithLogger(l),
+		profile.NoShutdownHook,
+	)
+	query := profile.Start(
+		profile.WithGoroutineProfileFile("query.goroutine"),
+		profile.WithName("query"),
+		profile.WithLogger(l),
+		profile.NoShutdownHook,
+	)
+	query.Stop()
+	ingest.Stop()
+
+	t.Log(buf.String())
+	for _, expect := range []string{
+		"[ingest] mem profile: started",
+		"[query] goroutine profile: started",
+		"[query] goroutine profile: stopped",
+		"[ingest] mem profile: stopped",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected %q in output", expect)
+		}
+	}
+}
+
+func TestNameFormatVerbs(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.MemProfile,
+		profile.WithName("100%s"),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	t.Log(buf.String())
+	expect := "[100%s] mem profile: started (mem.pprof)"
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatalf("expected %q in output", expect)
+	}
+}
+
+func TestWithID(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.CPUProfile,
+		profile.WithID("4bf92f35"),
+		profile.WithIDFilenames(),
+		profile.WithName("ingest"),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	t.Log(buf.String())
+	for _, expect := range []string{
+		"[ingest id=4bf92f35] cpu profile: started (cpu-4bf92f35.pprof)",
+		"[ingest id=4bf92f35] cpu profile: stopped",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected %q in output", expect)
+		}
+	}
+
+	AssertDirContains(t, dir, []string{"cpu-4bf92f35.pprof"})
+}
+
+func TestIDFormatVerbs(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.MemProfile,
+		profile.WithID("%d%v"),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	t.Log(buf.String())
+	expect := "[id=%d%v] mem profile: started (mem.pprof)"
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatalf("expected %q in output", expect)
+	}
+}
+
+func TestConfigDump(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	p := profile.New(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.GoroutineProfile,
+		profile.WithConfigDump(),
+		profile.WithLogger(log.New(buf, "", 0)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-cpuprofile=cpu.out", "-memprofile=mem.out", "-memprofilerate=512"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	t.Log(buf.String())
+	for _, expect := range []string{
+		"config: cpu: cpu.out\n",
+		"config: mem: mem.out\n",
+		"config: mem: memprofilerate=512\n",
+		"config: goroutine: disabled\n",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected %q in output", expect)
+		}
+	}
+}
+
+func TestWithQuietMethods(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.TraceProfile,
+		profile.WithQuietMethods("trace"),
+		profile.WithClock(FixedClock()),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	expect := strings.Join([]string{
+		"mem profile: started (mem.pprof)",
+		CPUParallelismLog(),
+		"cpu profile: started (cpu.pprof)",
+		"cpu profile: stopped",
+		"mem profile: stopped",
+		"profiling stopped after 0s",
+	}, "\n") + "\n"
+	if buf.String() != expect {
+		t.Fatalf("got log output\n%s\nexpect\n%s", buf, expect)
+	}
+	AssertDirContains(t, dir, []string{"cpu.pprof", "mem.pprof", "trace.out"})
+}
+
+func TestVerbosity(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	cases := []struct {
+		Level  int
+		Expect []string
+		Reject []string
+	}{
+		{
+			Level:  0,
+			Expect: []string{"cpu profile: error starting"},
+			Reject: []string{"mem profile: started", "mem profile: output file"},
+		},
+		{
+			Level:  1,
+			Expect: []string{"cpu profile: error starting", "mem profile: started"},
+			Reject: []string{"mem profile: output file"},
+		},
+		{
+			Level: 2,
+			Expect: []string{
+				"cpu profile: error starting",
+				"mem profile: started",
+				"mem profile: output file mem.out",
+				"mem profile: flag memprofilerate=0",
+			},
+		},
+	}
+	for _, c := range cases {
+		buf := new(bytes.Buffer)
+		p := profile.New(
+			profile.CPUProfile,
+			profile.MemProfile,
+			profile.WithVerbosity(c.Level),
+			profile.WithLogger(log.New(buf, "", 0)),
+		)
+
+		f := flag.NewFlagSet("profile", flag.ContinueOnError)
+		p.SetFlags(f)
+		args := []string{"-cpuprofile=missing/cpu.out", "-memprofile=mem.out"}
+		if err := f.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+
+		p.Start().Stop()
+
+		output := buf.String()
+		t.Logf("level %d:\n%s", c.Level, output)
+		for _, expect := range c.Expect {
+			if !strings.Contains(output, expect) {
+				t.Errorf("level %d: expected %q in output", c.Level, expect)
+			}
+		}
+		for _, reject := range c.Reject {
+			if strings.Contains(output, reject) {
+				t.Errorf("level %d: unexpected %q in output", c.Level, reject)
+			}
+		}
+	}
+}
+
+func TestCPUParallelismLog(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.CPUProfile,
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	t.Log(buf.String())
+	expect := CPUParallelismLog()
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatalf("expected %q in output", expect)
+	}
+}
+
+func TestStopDuration(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Clock advances 12.3s on each call.
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(12300 * time.Millisecond)
+		return now
+	}
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.CPUProfile,
+		profile.WithClock(clock),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	t.Log(buf.String())
+	if !strings.Contains(buf.String(), "profiling stopped after 12.3s") {
+		t.Fatal("expected stop log to include duration")
+	}
+}
+
+func TestDebugOutput(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Options  []func(*profile.Profile)
+		Args     []string
+		File     string
+		Header   string
+		Contains string
+	}{
+		{
+			Name:     "mem",
+			Options:  []func(*profile.Profile){profile.MemProfile},
+			Args:     []string{"-memprofile=mem.txt", "-memprofiledebug=1"},
+			File:     "mem.txt",
+			Header:   "heap profile:",
+			Contains: "# runtime.MemStats",
+		},
+		{
+			Name:     "block",
+			Options:  []func(*profile.Profile){profile.BlockProfile},
+			Args:     []string{"-blockprofile=block.txt", "-blockprofiledebug=1"},
+			File:     "block.txt",
+			Header:   "--- contention:",
+			Contains: "cycles/second=",
+		},
+		{
+			Name:     "mutex",
+			Options:  []func(*profile.Profile){profile.MutexProfile},
+			Args:     []string{"-mutexprofile=mutex.txt", "-mutexprofiledebug=1"},
+			File:     "mutex.txt",
+			Header:   "--- mutex:",
+			Contains: "cycles/second=",
+		},
+	}
+	for _, c := range cases {
+		c := c // scopelint
+		t.Run(c.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			Chdir(t, dir)
+
+			p := profile.New(c.Options...)
+			p.Configure(profile.WithLogger(Logger(t)))
+
+			f := flag.NewFlagSet("profile", flag.ContinueOnError)
+			p.SetFlags(f)
+			if err := f.Parse(c.Args); err != nil {
+				t.Fatal(err)
+			}
+
+			p.Start()
+			contend()
+			p.Stop()
+
+			b, err := ioutil.ReadFile(c.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("output:\n%s", b)
+
+			if !bytes.HasPrefix(b, []byte(c.Header)) || !bytes.Contains(b, []byte(c.Contains)) {
+				t.Fatal("expected legacy text format output")
+			}
+		})
+	}
+}
+
+// contend causes goroutine blocking and mutex contention.
+func contend() {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				mu.Lock()
+				time.Sleep(10 * time.Microsecond)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func TestEnvConfiguration(t *testing.T) {
 	dir := t.TempDir()
 	Chdir(t, dir)
 
 	// Set the environment variable for this test.
 	key := "PROFILE"
-	Setenv(t, key, "cpuprofile=cpu.out,memprofile=mem.out")
+	Setenv(t, key, "cpuprofile=cpu.out,memprofile=mem.out")
+
+	// Run profiler.
+	profile.Start(
+		profile.AllProfiles,
+		profile.ConfigEnvVar(key),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	// Verify we have what we expect.
+	AssertDirContains(t, dir, []string{"cpu.out", "mem.out"})
+}
+
+func TestEnvConfigurationMalformed(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	key := "PROFILE"
+	Setenv(t, key, " cpuprofile ,, bogus=1, memprofile = mem.out ,memprofilerate=x,")
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.AllProfiles,
+		profile.ConfigEnvVar(key),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+
+	t.Log(buf.String())
+	for _, expect := range []string{
+		`config: invalid setting "cpuprofile": expected key=value`,
+		`config: unknown key "bogus"`,
+		`config: invalid value "x" for memprofilerate`,
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected %q in output", expect)
+		}
+	}
+
+	// Valid settings should still apply.
+	AssertDirContains(t, dir, []string{"mem.out"})
+}
+
+func TestEnvConfigurationFlagPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	key := "PROFILE"
+	Setenv(t, key, "cpuprofile=env.out,memprofile=mem.out")
 
-	// Run profiler.
-	profile.Start(
+	p := profile.New(
 		profile.AllProfiles,
 		profile.ConfigEnvVar(key),
 		profile.WithLogger(Logger(t)),
-	).Stop()
+	)
 
-	// Verify we have what we expect.
-	AssertDirContains(t, dir, []string{"cpu.out", "mem.out"})
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-cpuprofile=flag.out"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	// Command-line flag wins for cpu, environment applies to mem.
+	AssertDirContains(t, dir, []string{"flag.out", "mem.out"})
 }
 
 // TestEnvConfigurationEmpty is a regression test for the case where a
@@ -187,6 +1282,385 @@ func TestEnvConfigurationEmpty(t *testing.T) {
 	AssertDirContains(t, dir, nil)
 }
 
+func TestIf(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Options []func(*profile.Profile)
+		Files   []string
+	}{
+		{
+			Name:    "true",
+			Options: []func(*profile.Profile){profile.If(true, profile.CPUProfile)},
+			Files:   []string{"cpu.pprof"},
+		},
+		{
+			Name:    "false",
+			Options: []func(*profile.Profile){profile.If(false, profile.CPUProfile)},
+		},
+		{
+			Name: "mixed",
+			Options: []func(*profile.Profile){
+				profile.If(false, profile.CPUProfile),
+				profile.If(true, profile.MemProfile),
+			},
+			Files: []string{"mem.pprof"},
+		},
+	}
+	for _, c := range cases {
+		c := c // scopelint
+		t.Run(c.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			Chdir(t, dir)
+
+			p := profile.New(c.Options...)
+			p.Configure(profile.WithLogger(Logger(t)))
+			p.Start().Stop()
+
+			AssertDirContains(t, dir, c.Files)
+		})
+	}
+}
+
+func TestEnabledMethods(t *testing.T) {
+	p := profile.New(profile.AllProfiles)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-trace=trace.out"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := p.EnabledMethods()
+	expect := []string{"trace"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("EnabledMethods() = %v; expect %v", got, expect)
+	}
+}
+
+func TestWithOverheadBudget(t *testing.T) {
+	cases := []struct {
+		Level  string
+		Expect []string
+	}{
+		{Level: "low", Expect: []string{"cpu", "mem", "goroutine"}},
+		{Level: "medium", Expect: []string{"cpu", "mem", "goroutine", "threadcreate", "metrics", "gctrace"}},
+		{Level: "high", Expect: []string{"cpu", "mem", "goroutine", "threadcreate", "metrics", "gctrace", "block", "mutex", "trace"}},
+	}
+	for _, c := range cases {
+		p := profile.New(profile.WithOverheadBudget(c.Level), profile.WithLogger(Logger(t)))
+		got := p.EnabledMethods()
+		if !reflect.DeepEqual(got, c.Expect) {
+			t.Errorf("%s: EnabledMethods() = %v; expect %v", c.Level, got, c.Expect)
+		}
+	}
+}
+
+func TestWithOverheadBudgetUnknown(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		strict := strict // scopelint
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			dir := t.TempDir()
+			Chdir(t, dir)
+
+			opts := []func(*profile.Profile){
+				profile.WithOverheadBudget("extreme"),
+				profile.WithLogger(Logger(t)),
+			}
+			if strict {
+				opts = append(opts, profile.WithStrict())
+			}
+			p := profile.New(opts...)
+			err := p.TryStart()
+			p.Stop()
+			if err == nil || !strings.Contains(err.Error(), `unknown level "extreme"`) {
+				t.Fatalf("TryStart() = %v; expect unknown level error", err)
+			}
+
+			// Expect no profiles, rather than the default cpu profile.
+			AssertDirContains(t, dir, nil)
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	p := profile.New(
+		profile.WithCPUProfileFile("default.cpu"),
+		profile.MemProfile,
+		profile.BlockProfile,
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-memprofile=flag.mem", "-blockprofile=block.out", "-blockprofilerate=0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := p.Describe()
+	expect := []profile.MethodInfo{
+		{Name: "cpu", Filename: "default.cpu", Enabled: true},
+		{Name: "mem", Filename: "flag.mem", Enabled: true},
+		{Name: "block", Filename: "block.out", Enabled: false},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Describe() = %v; expect %v", got, expect)
+	}
+}
+
+func TestExplicitFilename(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Set filenames in code, without flags.
+	profile.Start(
+		profile.WithCPUProfileFile("explicit.cpu"),
+		profile.MemProfile,
+		profile.WithMemProfileFile("explicit.mem"),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	AssertDirContains(t, dir, []string{"explicit.cpu", "explicit.mem"})
+}
+
+func TestExplicitFilenameFlags(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.AllProfiles,
+		profile.WithTraceFile("explicit.trace"),
+		profile.WithLogger(Logger(t)),
+	)
+
+	// Explicit filenames remain enabled when flags are registered.
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-cpuprofile=cpu.out"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	AssertDirContains(t, dir, []string{"cpu.out", "explicit.trace"})
+}
+
+var sink []byte
+
+//go:noinline
+func allocbefore() {
+	for i := 0; i < 256; i++ {
+		sink = make([]byte, 1<<16)
+	}
+}
+
+//go:noinline
+func allocduring() {
+	for i := 0; i < 256; i++ {
+		sink = make([]byte, 1<<16)
+	}
+}
+
+func TestTraceConverter(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	var paths []string
+	profile.Start(
+		profile.WithTraceFile("trace.out"),
+		profile.WithOutputDir(dir),
+		profile.WithTraceConverter(func(path string) error {
+			// Expect the trace to be complete.
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if len(b) == 0 {
+				t.Errorf("trace %s is empty", path)
+			}
+			paths = append(paths, path)
+			return nil
+		}),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	expect := []string{filepath.Join(dir, "trace.out")}
+	if !reflect.DeepEqual(paths, expect) {
+		t.Fatalf("converter called with %v; expect %v", paths, expect)
+	}
+}
+
+func TestMemProfileNoGC(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	profile.Start(
+		profile.MemProfile,
+		profile.WithMemProfileNoGC(),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	AssertDirContains(t, dir, []string{"mem.pprof"})
+
+	f, err := os.Open("mem.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := pprofile.Parse(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeltaMemProfileNoGC(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Disable automatic collections, so any are forced by profiling.
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	profile.Start(
+		profile.DeltaMemProfile,
+		profile.WithMemProfileNoGC(),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+	runtime.ReadMemStats(&after)
+
+	if n := after.NumGC - before.NumGC; n != 0 {
+		t.Fatalf("%d garbage collections; expect none", n)
+	}
+	AssertDirContains(t, dir, []string{"deltamem.pprof"})
+}
+
+func TestDeltaMemProfileWriteRetries(t *testing.T) {
+	fs := &FlakyFS{MemFS: NewMemFS(), Err: syscall.EAGAIN, Failures: 1}
+	profile.Start(
+		profile.DeltaMemProfile,
+		profile.WithFilesystem(fs),
+		profile.WithWriteRetries(1),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	if len(fs.Bytes("deltamem.pprof")) == 0 {
+		t.Fatal("profile not written")
+	}
+}
+
+func TestDeltaMemProfile(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Allocate before profiling, which should not appear in the profile.
+	allocbefore()
+
+	p := profile.New(profile.DeltaMemProfile, profile.WithLogger(Logger(t)))
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-deltamemprofile=delta.pprof", "-deltamemprofilerate=1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start()
+	allocduring()
+	p.Stop()
+
+	// Parse the profile and sum allocated space per function.
+	r, err := os.Open("delta.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	prof, err := pprofile.Parse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := SampleIndex(t, prof, "alloc_space")
+
+	space := map[string]int64{}
+	for _, s := range prof.Sample {
+		for _, ln := range s.Location[0].Line {
+			space[ln.Function.Name] += s.Value[index]
+		}
+	}
+
+	before := space["github.com/mmcloughlin/profile_test.allocbefore"]
+	during := space["github.com/mmcloughlin/profile_test.allocduring"]
+	t.Logf("allocated before=%d during=%d", before, during)
+
+	if before != 0 {
+		t.Errorf("allocations before Start appear in delta profile")
+	}
+	if expect := int64(256 << 16); during < expect {
+		t.Errorf("allocations during profiling %d; expect at least %d", during, expect)
+	}
+}
+
+//go:noinline
+func allocsmall() {
+	for i := 0; i < 4096; i++ {
+		sink = make([]byte, 16)
+	}
+}
+
+//go:noinline
+func alloclarge() {
+	for i := 0; i < 16; i++ {
+		sink = make([]byte, 1<<16)
+	}
+}
+
+func TestMinAllocSize(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.MemProfile,
+		profile.WithMinAllocSize(1<<10),
+		profile.WithLogger(Logger(t)),
+	)
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-memprofile=mem.pprof", "-memprofilerate=1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start()
+	allocsmall()
+	alloclarge()
+	p.Stop()
+
+	// Parse the profile and collect allocating functions.
+	r, err := os.Open("mem.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	prof, err := pprofile.Parse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sites := map[string]bool{}
+	for _, s := range prof.Sample {
+		for _, ln := range s.Location[0].Line {
+			sites[ln.Function.Name] = true
+		}
+	}
+
+	if sites["github.com/mmcloughlin/profile_test.allocsmall"] {
+		t.Error("small allocation site should be filtered")
+	}
+	if !sites["github.com/mmcloughlin/profile_test.alloclarge"] {
+		t.Error("large allocation site should remain")
+	}
+}
+
 // AssertDirContains asserts that dir contains non-empty files called filenames,
 // and nothing else.
 func AssertDirContains(t *testing.T, dir string, filenames []string) {
@@ -258,6 +1732,43 @@ func Setenv(t *testing.T, key, value string) {
 	}
 }
 
+// LineWriter builds a writer that sends each write to the given channel.
+func LineWriter(lines chan<- string) io.Writer {
+	return linewriter(lines)
+}
+
+type linewriter chan<- string
+
+func (w linewriter) Write(p []byte) (n int, err error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+// FixedClock returns a clock that always reports the same time, so logged
+// durations are deterministic.
+func FixedClock() func() time.Time {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	return func() time.Time { return now }
+}
+
+// SampleIndex returns the index of the sample value of prof with the given
+// type, failing the test if there is none.
+func SampleIndex(t *testing.T, prof *pprofile.Profile, typ string) int {
+	t.Helper()
+	for i, st := range prof.SampleType {
+		if st.Type == typ {
+			return i
+		}
+	}
+	t.Fatalf("no %s sample type", typ)
+	return -1
+}
+
+// CPUParallelismLog returns the line logged by the CPU profile on start.
+func CPUParallelismLog() string {
+	return fmt.Sprintf("cpu profile: GOMAXPROCS=%d NumCPU=%d", runtime.GOMAXPROCS(0), runtime.NumCPU())
+}
+
 // Logger builds a logger that writes to the test object.
 func Logger(tb testing.TB) *log.Logger {
 	tb.Helper()
@@ -278,3 +1789,85 @@ func (w writer) Write(p []byte) (n int, err error) {
 	w.tb.Log(string(p))
 	return len(p), nil
 }
+
+func TestFullMemProfile(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(profile.FullMemProfile, profile.WithLogger(Logger(t)))
+	allocduring()
+	p.Stop()
+
+	AssertDirContains(t, dir, []string{"allocs.pprof", "heap.pprof"})
+
+	// Verify each is a valid profile, and that the allocs profile reports
+	// allocated space by default.
+	for _, filename := range []string{"allocs.pprof", "heap.pprof"} {
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prof, err := pprofile.Parse(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filename == "allocs.pprof" && prof.DefaultSampleType != "alloc_space" {
+			t.Errorf("%s: default sample type %q; expect alloc_space", filename, prof.DefaultSampleType)
+		}
+	}
+}
+
+func TestFullMemProfileFilenames(t *testing.T) {
+	cases := []struct {
+		Allocs string
+		Heap   string
+	}{
+		{Allocs: "run1.allocs.pprof", Heap: "run1.heap.pprof"},
+		{Allocs: "mem.pprof", Heap: "mem.heap.pprof"},
+		{Allocs: "heap.pprof", Heap: "heap.heap.pprof"},
+	}
+	for _, c := range cases {
+		c := c // scopelint
+		t.Run(c.Allocs, func(t *testing.T) {
+			dir := t.TempDir()
+			Chdir(t, dir)
+
+			profile.Start(
+				profile.WithFullMemProfileFile(c.Allocs),
+				profile.WithLogger(Logger(t)),
+			).Stop()
+
+			AssertDirContains(t, dir, []string{c.Allocs, c.Heap})
+		})
+	}
+}
+
+func TestFullDumpProfile(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(profile.FullDumpProfile, profile.WithLogger(Logger(t)))
+
+	f := flag.NewFlagSet("profile", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse([]string{"-fulldump=dump.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Start().Stop()
+
+	b, err := ioutil.ReadFile("dump.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := string(b)
+
+	// Expect multiple stacks, including this test.
+	if n := strings.Count(dump, "goroutine "); n < 2 {
+		t.Errorf("found %d goroutine headers; expect multiple", n)
+	}
+	if !strings.Contains(dump, "TestFullDumpProfile") {
+		t.Error("expected test goroutine in dump")
+	}
+}
@@ -0,0 +1,72 @@
+package profile
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// SetMutexFraction changes the mutex profile fraction of a running mutex
+// profile, allowing contention sampling to be adjusted without restarting. See
+// runtime.SetMutexProfileFraction. Has no effect if the mutex profile is not
+// running.
+func (p *Profile) SetMutexFraction(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, ok := p.runningmethod("mutex").(*mutex)
+	if !ok {
+		p.log("mutex profile: not running: cannot set fraction")
+		return
+	}
+
+	m.rate = n
+	runtime.SetMutexProfileFraction(n)
+	p.info("mutex profile: fraction set to %d", n)
+}
+
+// SetBlockRate changes the block profile rate of a running block profile,
+// allowing sampling to be adjusted without restarting. See
+// runtime.SetBlockProfileRate. Has no effect if the block profile is not
+// running.
+func (p *Profile) SetBlockRate(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, ok := p.runningmethod("block").(*block)
+	if !ok {
+		p.log("block profile: not running: cannot set rate")
+		return
+	}
+
+	b.rate = n
+	b.period = 0
+	setblockrate(n)
+	p.info("block profile: rate set to %d", n)
+}
+
+// runningmethod returns the running method with the given name, or nil if there
+// is none.
+func (p *Profile) runningmethod(name string) method {
+	for _, m := range p.running {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// lastblockrate is the block profile rate most recently set by this package.
+var lastblockrate int64
+
+// setblockrate sets the block profile rate. See runtime.SetBlockProfileRate.
+func setblockrate(n int) {
+	atomic.StoreInt64(&lastblockrate, int64(n))
+	runtime.SetBlockProfileRate(n)
+}
+
+// blockrate returns the block profile rate. Since the runtime provides no way
+// to query it, this is the rate most recently set by this package, or zero if
+// none has been.
+func blockrate() int {
+	return int(atomic.LoadInt64(&lastblockrate))
+}
@@ -0,0 +1,111 @@
+package profile_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestSetMutexFraction(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(profile.MutexProfile, profile.WithLogger(Logger(t)))
+
+	p.SetMutexFraction(5)
+	if got := runtime.SetMutexProfileFraction(-1); got != 5 {
+		t.Fatalf("mutex profile fraction %d; expect 5", got)
+	}
+	contend()
+
+	p.SetMutexFraction(1)
+	contend()
+
+	p.Stop()
+
+	AssertDirContains(t, dir, []string{"mutex.pprof"})
+}
+
+func TestSetBlockRate(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(profile.BlockProfile, profile.WithLogger(Logger(t)))
+	p.SetBlockRate(1000)
+	contend()
+	p.Stop()
+
+	AssertDirContains(t, dir, []string{"block.pprof"})
+}
+
+func TestSetRateNotRunning(t *testing.T) {
+	p := profile.New(profile.MutexProfile, profile.WithLogger(Logger(t)))
+	p.SetMutexFraction(5)
+	if got := runtime.SetMutexProfileFraction(-1); got == 5 {
+		t.Fatal("unexpected fraction change when not running")
+	}
+}
+
+func TestRestoreMutexFraction(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	prev := runtime.SetMutexProfileFraction(7)
+	defer runtime.SetMutexProfileFraction(prev)
+
+	profile.Start(profile.MutexProfile, profile.WithLogger(Logger(t))).Stop()
+
+	if got := runtime.SetMutexProfileFraction(-1); got != 7 {
+		t.Fatalf("mutex profile fraction %d after stop; expect 7", got)
+	}
+}
+
+func TestRestoreBlockRate(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Enable block profiling in an outer session, then run an inner one.
+	outer := profile.Start(profile.WithBlockProfileFile("outer.pprof"), profile.WithLogger(Logger(t)))
+	defer outer.Stop()
+
+	profile.Start(profile.WithBlockProfileFile("inner.pprof"), profile.WithLogger(Logger(t))).Stop()
+
+	// Block profiling should still be enabled.
+	before := blockevents(t, outer)
+	blockafter()
+	if blockevents(t, outer) <= before {
+		t.Fatal("expected block profiling to remain enabled")
+	}
+}
+
+// blockevents returns the number of blocking events recorded in blockafter.
+func blockevents(t *testing.T, p *profile.Profile) int64 {
+	t.Helper()
+	prof, err := p.Collect("block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for _, s := range prof.Sample {
+		for _, l := range s.Location {
+			for _, ln := range l.Line {
+				if ln.Function.Name == "github.com/mmcloughlin/profile_test.blockafter" {
+					n += s.Value[0]
+				}
+			}
+		}
+	}
+	return n
+}
+
+//go:noinline
+func blockafter() {
+	ch := make(chan struct{})
+	go func() {
+		time.Sleep(time.Millisecond)
+		close(ch)
+	}()
+	<-ch
+}
@@ -0,0 +1,162 @@
+package profile
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithRotation configures the cpu profile and execution trace to rotate to a
+// new output file once maxBytes have been written, keeping only the most
+// recent keep files. Since profiles cannot be split, rotation stops and
+// restarts profiling so each file is individually valid. Files are numbered:
+// for example, with the default filename the execution trace is written to
+// trace-0001.out, trace-0002.out and so on. Pruning is only supported for the
+// operating system filesystem. A keep of zero or less keeps all files.
+//
+// Rotation is intended to bound the disk usage of unattended capture. Output
+// size is checked periodically, so files may exceed maxBytes slightly. The cpu
+// profile is not rotated when gated with WithGate.
+func WithRotation(maxBytes int64, keep int) func(*Profile) {
+	return func(p *Profile) {
+		p.rotatebytes = maxBytes
+		p.rotatekeep = keep
+	}
+}
+
+// rotateinterval is how often the size of rotating output is checked.
+const rotateinterval = 100 * time.Millisecond
+
+// rotator writes a streaming profile to a sequence of files, moving to the
+// next file when the current one reaches a size limit.
+type rotator struct {
+	p         *Profile
+	m         method
+	limit     int64
+	startfn   func(w io.Writer) error
+	stopfn    func()
+	n         int
+	f         io.WriteCloser
+	size      *sizewriter
+	filenames []string
+	poller    *poller
+
+	mu      sync.Mutex // protects current, for readers outside the poller
+	current string
+}
+
+// startrotation starts the streaming profile of method m with rotation,
+// checked every interval against the size limit. A zero limit rotates on every
+// check. The start and stop functions control the underlying profile, for
+// example pprof.StartCPUProfile and pprof.StopCPUProfile.
+func (p *Profile) startrotation(
+	m method,
+	interval time.Duration,
+	limit int64,
+	start func(w io.Writer) error,
+	stop func(),
+) (*rotator, error) {
+	r := &rotator{p: p, m: m, limit: limit, startfn: start, stopfn: stop}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.poller = poll(interval, r.check)
+	return r, nil
+}
+
+// open starts profiling to the next output file.
+func (r *rotator) open() error {
+	r.n++
+	filename := seqfilename(r.m.Filename(), r.n)
+	f, err := r.p.create(r.m, filename)
+	if err != nil {
+		return err
+	}
+
+	size := &sizewriter{w: f}
+	if err := r.startfn(size); err != nil {
+		_ = f.Close() // best effort: ignore error since we already have one
+		return err
+	}
+
+	r.f, r.size = f, size
+	r.filenames = append(r.filenames, filename)
+	r.mu.Lock()
+	r.current = filename
+	r.mu.Unlock()
+	r.prune()
+
+	return nil
+}
+
+// currentfile returns the output file currently being written.
+func (r *rotator) currentfile() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// close stops profiling to the current output file.
+func (r *rotator) close() error {
+	r.stopfn()
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// check rotates to a new output file if the current one has reached the size
+// limit.
+func (r *rotator) check() {
+	if r.f == nil || r.size.written() < r.limit {
+		return
+	}
+	if err := r.close(); err != nil {
+		r.p.log("%s profile: error closing rotated output: %v", r.m.Name(), err)
+	}
+	if err := r.open(); err != nil {
+		r.p.log("%s profile: error rotating output: %v", r.m.Name(), err)
+		return
+	}
+	r.p.info("%s profile: rotated output to %s", r.m.Name(), r.filenames[len(r.filenames)-1])
+}
+
+// prune removes the oldest output files in excess of the configured number to
+// keep, where supported by the filesystem.
+func (r *rotator) prune() {
+	keep := r.p.rotatekeep
+	rm, ok := r.p.fs.(remover)
+	if keep <= 0 || !ok || r.p.archive != nil {
+		return
+	}
+	for len(r.filenames) > keep {
+		path := r.p.methodpath(r.m, r.filenames[0])
+		if err := rm.remove(path); err != nil {
+			r.p.log("%s profile: error pruning rotated output %s: %v", r.m.Name(), path, err)
+		}
+		r.filenames = r.filenames[1:]
+	}
+}
+
+// stop stops rotation and profiling.
+func (r *rotator) stop() error {
+	r.poller.stop()
+	if r.f != nil {
+		return r.close()
+	}
+	return nil
+}
+
+// sizewriter counts bytes written, and may be read concurrently with writes.
+type sizewriter struct {
+	w io.Writer
+	n int64
+}
+
+func (s *sizewriter) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	atomic.AddInt64(&s.n, int64(n))
+	return n, err
+}
+
+func (s *sizewriter) written() int64 { return atomic.LoadInt64(&s.n) }
@@ -0,0 +1,93 @@
+package profile_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	p := profile.Start(
+		profile.TraceProfile,
+		profile.WithOutputDir(dir),
+		profile.WithRotation(1, 2),
+		profile.WithLogger(Logger(t)),
+	)
+
+	// Generate trace events for long enough to rotate several times.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		contend()
+	}
+
+	p.Stop()
+
+	// Expect only the most recent files to be kept.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d files; expect 2", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Name() == "trace-0001.out" {
+			t.Fatalf("expected %s to be pruned", entry.Name())
+		}
+
+		// Each file should be a complete trace.
+		b, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, []byte("go 1.")) {
+			t.Fatalf("%s: missing trace header", entry.Name())
+		}
+	}
+}
+
+func TestWithTraceSplit(t *testing.T) {
+	dir := t.TempDir()
+
+	p := profile.Start(
+		profile.TraceProfile,
+		profile.WithOutputDir(dir),
+		profile.WithTraceSplit(100*time.Millisecond),
+		profile.WithLogger(Logger(t)),
+	)
+
+	deadline := time.Now().Add(350 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		contend()
+	}
+
+	p.Stop()
+
+	// Expect multiple segments, each a complete trace.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 3 {
+		t.Fatalf("got %d segments; expect at least 3", len(entries))
+	}
+	for i, entry := range entries {
+		if expect := fmt.Sprintf("trace-%04d.out", i+1); entry.Name() != expect {
+			t.Fatalf("segment %d is %s; expect %s", i+1, entry.Name(), expect)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, []byte("go 1.")) {
+			t.Fatalf("%s: missing trace header", entry.Name())
+		}
+	}
+}
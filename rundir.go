@@ -0,0 +1,72 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WithRunDir configures each profiling run to write its output to a fresh
+// directory, named for the start time and process ID. For example, output may
+// be written to profiles/20210102T150405.000-1234/cpu.pprof. This isolates
+// runs sharing a workspace, such as parallel CI jobs. If the directory already
+// exists, a numeric suffix is added to the name. The run directory is created
+// within the output directory, if configured. The accumulated profile of
+// WithMergeInto is not written to the run directory, since it accumulates
+// across runs. Only supported for the operating system filesystem.
+func WithRunDir() func(*Profile) {
+	return func(p *Profile) { p.rundir = true }
+}
+
+// rundirbase is the directory run directories are created in.
+const rundirbase = "profiles"
+
+// mkdirer is implemented by filesystems that can create directories.
+type mkdirer interface {
+	mkdir(name string) error
+}
+
+// mkdir creates the named directory, which must not already exist, along
+// with any missing parents.
+func (osfs) mkdir(name string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	return os.Mkdir(name, 0o755)
+}
+
+// makerundir creates the run directory, if configured, and directs output to
+// it.
+func (p *Profile) makerundir() {
+	p.runpath = ""
+	if !p.rundir || p.dryrun {
+		return
+	}
+
+	mk, ok := p.fs.(mkdirer)
+	if !ok {
+		p.log("rundir: not supported by filesystem")
+		p.starterror(errors.New("rundir: not supported by filesystem"))
+		return
+	}
+
+	// Create the directory, adding a suffix if the name is taken.
+	name := fmt.Sprintf("%s-%d", p.clock().Format("20060102T150405.000"), os.Getpid())
+	dir := filepath.Join(rundirbase, name)
+	for n := 2; ; n++ {
+		err := mk.mkdir(p.path(dir))
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			p.log("rundir: error creating directory: %v", err)
+			p.starterror(fmt.Errorf("rundir: %w", err))
+			return
+		}
+		dir = filepath.Join(rundirbase, fmt.Sprintf("%s-%d", name, n))
+	}
+
+	p.runpath = dir
+	p.info("rundir: writing output to %s", p.path(""))
+}
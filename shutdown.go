@@ -0,0 +1,86 @@
+package profile
+
+import (
+	"os"
+	"runtime/pprof"
+)
+
+// WithShutdownFunc registers a function to be called by the shutdown hook
+// after profiles have been stopped, but before the program exits. This allows
+// programs to flush logs or close connections that would otherwise be skipped
+// by the exit. Functions are called in the order they were registered.
+func WithShutdownFunc(fn func()) func(*Profile) {
+	return func(p *Profile) { p.shutdownfuncs = append(p.shutdownfuncs, fn) }
+}
+
+// WithShutdownExit controls whether the shutdown hook exits the program after
+// stopping profiles. Defaults to true. When disabled the hook returns after
+// stopping profiles, leaving the program to complete its own shutdown. Note
+// that other handlers registered with signal.Notify also receive the signal.
+func WithShutdownExit(exit bool) func(*Profile) {
+	return func(p *Profile) { p.noshutdownexit = !exit }
+}
+
+// WithSignalGoroutineDump configures the shutdown hook to write a dump of all
+// goroutine stacks to standard error before stopping profiles. This can help
+// diagnose a hang that prompted the program to be interrupted. The dump is
+// written whether or not goroutine profiling is enabled.
+func WithSignalGoroutineDump() func(*Profile) {
+	return func(p *Profile) { p.goroutinedump = true }
+}
+
+// shutdown is called by the shutdown hook on receipt of signal s.
+func (p *Profile) shutdown(s os.Signal) {
+	if p.goroutinedump {
+		if err := pprof.Lookup("goroutine").WriteTo(p.stderr, 2); err != nil {
+			p.log("goroutine dump: %v", err)
+		}
+	}
+
+	p.info("caught %v: stopping profiles", s)
+	p.Stop()
+
+	for _, fn := range p.shutdownfuncs {
+		fn()
+	}
+
+	if !p.noshutdownexit {
+		p.exit(0)
+	}
+}
+
+// hook is a running shutdown hook.
+type hook struct {
+	c    chan os.Signal
+	done chan struct{}
+}
+
+// starthook starts a goroutine that calls the shutdown hook on interrupt. The
+// goroutine exits when the hook is stopped.
+func (p *Profile) starthook() {
+	h := &hook{
+		c:    make(chan os.Signal, 1),
+		done: make(chan struct{}),
+	}
+	p.notify(h.c, os.Interrupt)
+	go func() {
+		select {
+		case s := <-h.c:
+			p.stopnotify(h.c)
+			p.shutdown(s)
+		case <-h.done:
+		}
+	}()
+	p.hook = h
+}
+
+// stophook stops the shutdown hook, if running. It does not wait for the hook
+// goroutine to exit, since it may be called by the hook itself.
+func (p *Profile) stophook() {
+	if p.hook == nil {
+		return
+	}
+	p.stopnotify(p.hook.c)
+	close(p.hook.done)
+	p.hook = nil
+}
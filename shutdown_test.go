@@ -0,0 +1,151 @@
+package profile_test
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestShutdownFuncOrder(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Record the order of shutdown events.
+	var events []string
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.NoShutdownHook,
+		profile.WithLogger(Logger(t)),
+		profile.WithShutdownFunc(func() {
+			// Profiles should already be stopped and written.
+			AssertDirContains(t, dir, []string{"cpu.pprof"})
+			events = append(events, "func")
+		}),
+		profile.WithExit(func(code int) {
+			if code != 0 {
+				t.Errorf("exit code %d; expect 0", code)
+			}
+			events = append(events, "exit")
+		}),
+	)
+
+	p.Shutdown(os.Interrupt)
+
+	expect := []string{"func", "exit"}
+	if !reflect.DeepEqual(events, expect) {
+		t.Fatalf("got events %v; expect %v", events, expect)
+	}
+}
+
+func TestShutdownHookSignal(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Inject a signal source and exit function.
+	notified := make(chan chan<- os.Signal, 1)
+	stopped := make(chan chan<- os.Signal, 2)
+	exited := make(chan int, 1)
+	profile.Start(
+		profile.CPUProfile,
+		profile.WithLogger(Logger(t)),
+		profile.WithNotifier(
+			func(c chan<- os.Signal, sig ...os.Signal) {
+				if !reflect.DeepEqual(sig, []os.Signal{os.Interrupt}) {
+					t.Errorf("notify signals %v; expect interrupt", sig)
+				}
+				notified <- c
+			},
+			func(c chan<- os.Signal) { stopped <- c },
+		),
+		profile.WithExit(func(code int) { exited <- code }),
+	)
+
+	// Send a fake interrupt.
+	c := <-notified
+	c <- os.Interrupt
+
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Errorf("exit code %d; expect 0", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for exit")
+	}
+
+	if s := <-stopped; s != c {
+		t.Error("notifications stopped on unexpected channel")
+	}
+	AssertDirContains(t, dir, []string{"cpu.pprof"})
+}
+
+func TestShutdownNoExit(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.NoShutdownHook,
+		profile.WithLogger(Logger(t)),
+		profile.WithShutdownExit(false),
+		profile.WithExit(func(int) {
+			t.Fatal("unexpected exit")
+		}),
+	)
+
+	p.Shutdown(os.Interrupt)
+
+	AssertDirContains(t, dir, []string{"cpu.pprof"})
+}
+
+func TestSignalGoroutineDump(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	stderr := new(bytes.Buffer)
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.NoShutdownHook,
+		profile.WithLogger(Logger(t)),
+		profile.WithSignalGoroutineDump(),
+		profile.WithStderr(stderr),
+		profile.WithShutdownExit(false),
+	)
+
+	p.Shutdown(os.Interrupt)
+
+	dump := stderr.String()
+	t.Log(dump)
+	if !strings.Contains(dump, "goroutine ") || !strings.Contains(dump, "TestSignalGoroutineDump") {
+		t.Fatal("expected goroutine dump including the test goroutine")
+	}
+}
+
+func TestShutdownHookNoLeak(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// The signal package starts a goroutine on first use, which persists.
+	profile.Start(profile.MemProfile, profile.Quiet).Stop()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		profile.Start(profile.MemProfile, profile.Quiet).Stop()
+	}
+
+	// Hook goroutines exit asynchronously, so allow time to settle.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutine count increased from %d to %d", before, after)
+	}
+}
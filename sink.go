@@ -0,0 +1,44 @@
+package profile
+
+import (
+	"io"
+	"os"
+)
+
+// Sink is a destination for profile output, for example a network service.
+// Whereas a Filesystem models files, a Sink need only provide a writer for each
+// named output.
+type Sink interface {
+	// NewWriter returns a writer for the named output. The output is complete
+	// when the writer is closed.
+	NewWriter(name string) (io.WriteCloser, error)
+}
+
+// WithSink configures profiles to be written to the given sink. This replaces
+// any filesystem configured with WithFilesystem.
+func WithSink(s Sink) func(*Profile) {
+	return WithFilesystem(sinkfs{s})
+}
+
+// FileSink is a Sink that writes to files in the operating system filesystem.
+// This is the default.
+type FileSink struct{}
+
+// NewWriter creates the named file.
+func (FileSink) NewWriter(name string) (io.WriteCloser, error) { return os.Create(name) }
+
+func (FileSink) check(name string) error { return osfs{}.check(name) }
+
+// sinkfs adapts a Sink to the Filesystem interface.
+type sinkfs struct {
+	s Sink
+}
+
+func (fs sinkfs) Create(name string) (io.WriteCloser, error) { return fs.s.NewWriter(name) }
+
+func (fs sinkfs) check(name string) error {
+	if c, ok := fs.s.(checker); ok {
+		return c.check(name)
+	}
+	return nil
+}
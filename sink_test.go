@@ -0,0 +1,79 @@
+package profile_test
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithSink(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	sink := MemSink{NewMemFS()}
+	profile.Start(
+		profile.CPUProfile,
+		profile.WithSink(sink),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	// Verify the cpu profile was captured by the sink.
+	b := sink.Bytes("cpu.pprof")
+	if _, err := pprofile.Parse(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	AssertDirContains(t, dir, nil)
+}
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	profile.Start(
+		profile.CPUProfile,
+		profile.WithSink(profile.FileSink{}),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	AssertDirContains(t, dir, []string{"cpu.pprof"})
+}
+
+// MemSink is an in-memory sink.
+type MemSink struct {
+	*MemFS
+}
+
+// NewWriter creates the named output.
+func (s MemSink) NewWriter(name string) (io.WriteCloser, error) {
+	return s.Create(name)
+}
+
+func TestSinkDiscardEmpty(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Start a cpu profile, so that a second will fail to start, leaving an
+	// empty output in the sink.
+	first := profile.Start(profile.WithCPUProfileFile("first.pprof"), profile.WithLogger(Logger(t)))
+	defer first.Stop()
+
+	buf := new(bytes.Buffer)
+	profile.Start(
+		profile.WithCPUProfileFile("second.pprof"),
+		profile.WithSink(MemSink{NewMemFS()}),
+		profile.WithDiscardEmpty(),
+		profile.WithLogger(log.New(buf, "", 0)),
+	).Stop()
+	first.Stop()
+
+	// Sinks do not support removal, so the output is kept without error.
+	t.Log(buf.String())
+	if strings.Contains(buf.String(), "discard") {
+		t.Fatal("unexpected log about discarding output")
+	}
+}
@@ -0,0 +1,144 @@
+package profile
+
+import (
+	"fmt"
+	"time"
+)
+
+// snapshotter is implemented by methods that can write their profile at any
+// time, rather than requiring a window between Start and Stop.
+type snapshotter interface {
+	snapshot(p *Profile, filename string) error
+}
+
+func (m *mem) snapshot(p *Profile, filename string) error {
+	p.memgc()
+	return p.writeprofile(m, "allocs", filename, m.debug)
+}
+
+func (l *lookup) snapshot(p *Profile, filename string) error {
+	return p.writeprofile(l, l.name, filename, 0)
+}
+
+func (b *block) snapshot(p *Profile, filename string) error {
+	return p.writeprofile(b, "block", filename, b.debug)
+}
+
+func (m *mutex) snapshot(p *Profile, filename string) error {
+	return p.writeprofile(m, "mutex", filename, m.debug)
+}
+
+// Snapshot immediately writes the current profile for all enabled methods that
+// support it, without affecting the profiling session. Snapshots are written
+// to timestamped files, derived from each method's output file. For example, a
+// snapshot of the goroutine profile may be written to
+// goroutine-20210102T150405.000.pprof. Methods that require a profiling
+// window, such as the cpu profile and execution trace, are skipped.
+//
+// Snapshot may be called regardless of whether profiling has been started.
+// Note that the block and mutex profiles only contain data if their rates have
+// been set, typically by starting profiling.
+func (p *Profile) Snapshot() error {
+	p.setdefaults()
+
+	var enabled []method
+	for _, m := range p.methods {
+		if m.Enabled() {
+			enabled = append(enabled, m)
+		}
+	}
+
+	now := p.clock()
+	return p.snapshot(enabled, func(_ method, filename string) string {
+		return timefilename(filename, now)
+	})
+}
+
+// snapshot writes snapshots of the given methods, where supported, to
+// filenames derived from their output files with the name function.
+func (p *Profile) snapshot(methods []method, name func(m method, filename string) string) error {
+	var first error
+	for _, m := range methods {
+		s, ok := m.(snapshotter)
+		if !ok {
+			continue
+		}
+
+		filename := name(m, m.Filename())
+		if err := s.snapshot(p, filename); err != nil {
+			p.log("%s profile: error writing snapshot: %v", m.Name(), err)
+			if first == nil {
+				first = fmt.Errorf("%s profile: %w", m.Name(), err)
+			}
+			continue
+		}
+
+		p.info("%s profile: snapshot written to %s", m.Name(), filename)
+	}
+
+	return first
+}
+
+// WithPeriodicSnapshot configures snapshots of running profiles to be written
+// every interval, in the background. Snapshots are written to numbered files,
+// derived from each method's output file. For example, the third snapshot of
+// the block profile is written to block-0003.pprof. As with Snapshot, methods
+// that require a profiling window are skipped. Profiles are also written as
+// usual at Stop.
+func WithPeriodicSnapshot(interval time.Duration) func(*Profile) {
+	return func(p *Profile) { p.snapinterval = interval }
+}
+
+// WithInterval configures continuous profiling, for long-running processes
+// that may never call Stop. Profiles that support snapshots are written to
+// numbered files every interval, as with WithPeriodicSnapshot. The cpu profile
+// and execution trace are written in consecutive windows of the interval, each
+// to a numbered file, as with WithTraceSplit. For example, the cpu profile is
+// written to cpu-0001.pprof, cpu-0002.pprof and so on. Profiling continues
+// until Stop is called, or the process is interrupted.
+func WithInterval(d time.Duration) func(*Profile) {
+	return func(p *Profile) {
+		p.snapinterval = d
+		p.interval = d
+	}
+}
+
+// startsnapshots starts periodic snapshots of running methods, if configured.
+func (p *Profile) startsnapshots() {
+	if p.snapinterval <= 0 || len(p.running) == 0 {
+		return
+	}
+
+	running := append([]method(nil), p.running...)
+	p.snapshotter = poll(p.snapinterval, func() {
+		_ = p.snapshot(running, p.seqsnapshotname) // errors are logged
+	})
+}
+
+// seqsnapshotname returns the numbered snapshot filename for the next snapshot
+// of method m. Numbering is shared by periodic and on-demand snapshots, so
+// their files do not collide.
+func (p *Profile) seqsnapshotname(m method, filename string) string {
+	p.snapseqmu.Lock()
+	defer p.snapseqmu.Unlock()
+	if p.snapseq == nil {
+		p.snapseq = map[method]int{}
+	}
+	p.snapseq[m]++
+	return seqfilename(filename, p.snapseq[m])
+}
+
+// resetsnapshotseq restarts numbering of snapshots.
+func (p *Profile) resetsnapshotseq() {
+	p.snapseqmu.Lock()
+	defer p.snapseqmu.Unlock()
+	p.snapseq = nil
+}
+
+// stopsnapshots stops periodic snapshots, if running.
+func (p *Profile) stopsnapshots() {
+	if p.snapshotter != nil {
+		p.snapshotter.stop()
+		p.snapshotter = nil
+	}
+}
@@ -0,0 +1,128 @@
+package profile_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.New(
+		profile.CPUProfile,
+		profile.MemProfile,
+		profile.GoroutineProfile,
+		profile.WithLogger(Logger(t)),
+	)
+
+	if err := p.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expect timestamped goroutine and heap snapshots, and nothing for cpu.
+	for _, pattern := range []string{"goroutine-*.pprof", "mem-*.pprof"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 {
+			t.Errorf("expected one file matching %s; got %v", pattern, matches)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 files; got %d", len(entries))
+	}
+}
+
+func TestSnapshotWithClock(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	now := time.Date(2021, 1, 2, 15, 4, 5, 123e6, time.UTC)
+	p := profile.New(
+		profile.GoroutineProfile,
+		profile.WithClock(func() time.Time { return now }),
+		profile.WithLogger(Logger(t)),
+	)
+
+	if err := p.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	AssertDirContains(t, dir, []string{"goroutine-20210102T150405.123.pprof"})
+}
+
+func TestWithPeriodicSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(
+		profile.BlockProfile,
+		profile.WithPeriodicSnapshot(50*time.Millisecond),
+		profile.WithLogger(Logger(t)),
+	)
+	for i := 0; i < 5; i++ {
+		contend()
+		time.Sleep(50 * time.Millisecond)
+	}
+	p.Stop()
+
+	// Expect multiple numbered snapshots.
+	for _, filename := range []string{"block-0001.pprof", "block-0002.pprof", "block.pprof"} {
+		if _, err := os.Stat(filepath.Join(dir, filename)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWithInterval(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.BlockProfile,
+		profile.WithInterval(50*time.Millisecond),
+		profile.WithLogger(Logger(t)),
+	)
+	for i := 0; i < 5; i++ {
+		contend()
+		time.Sleep(50 * time.Millisecond)
+	}
+	p.Stop()
+
+	// Expect multiple numbered snapshots and windows.
+	for _, filename := range []string{
+		"block-0001.pprof", "block-0002.pprof", "block.pprof",
+		"cpu-0001.pprof", "cpu-0002.pprof", "cpu-0003.pprof",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, filename)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Expect no more output once stopped.
+	count := func() int {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	n := count()
+	time.Sleep(150 * time.Millisecond)
+	if count() != n {
+		t.Fatal("output written after stop")
+	}
+}
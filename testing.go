@@ -0,0 +1,27 @@
+package profile
+
+// TB is the subset of the testing.TB interface used by Test.
+type TB interface {
+	Cleanup(func())
+	Helper()
+	Logf(format string, args ...interface{})
+	TempDir() string
+}
+
+// Test starts a profiling session scoped to the test or benchmark tb. Profiles
+// are written to a temporary directory for the test, logs are routed to the
+// test log, and profiling is stopped when the test completes. The interrupt
+// shutdown hook is disabled. Options are applied after these defaults, so may
+// override them.
+func Test(tb TB, options ...func(*Profile)) *Profile {
+	tb.Helper()
+	p := New(
+		WithOutputDir(tb.TempDir()),
+		NoShutdownHook,
+		func(p *Profile) { p.logf = tb.Logf },
+	)
+	p.Configure(options...)
+	p.Start()
+	tb.Cleanup(p.Stop)
+	return p
+}
@@ -0,0 +1,68 @@
+package profile_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestTest(t *testing.T) {
+	tb := &FakeTB{dir: t.TempDir()}
+	profile.Test(tb, profile.CPUProfile, profile.MemProfile)
+
+	// Profiles are written to the test directory on cleanup.
+	tb.RunCleanup()
+
+	AssertDirContains(t, tb.dir, []string{"cpu.pprof", "mem.pprof"})
+
+	// Expect logs routed to the test.
+	logs := strings.Join(tb.logs, "\n")
+	t.Log(logs)
+	for _, expect := range []string{"cpu profile: started", "mem profile: stopped"} {
+		if !strings.Contains(logs, expect) {
+			t.Errorf("expected test log to contain %q", expect)
+		}
+	}
+}
+
+func TestTestRealTB(t *testing.T) {
+	var p *profile.Profile
+	t.Run("sub", func(t *testing.T) {
+		p = profile.Test(t, profile.CPUProfile)
+	})
+
+	// Subtest cleanup should have stopped profiling.
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// FakeTB records calls to the profile.TB interface.
+type FakeTB struct {
+	dir      string
+	logs     []string
+	cleanups []func()
+}
+
+// Cleanup records fn to be called by RunCleanup.
+func (tb *FakeTB) Cleanup(fn func()) { tb.cleanups = append(tb.cleanups, fn) }
+
+// Helper does nothing.
+func (tb *FakeTB) Helper() {}
+
+// Logf records a log message.
+func (tb *FakeTB) Logf(format string, args ...interface{}) {
+	tb.logs = append(tb.logs, fmt.Sprintf(format, args...))
+}
+
+// TempDir returns the configured directory.
+func (tb *FakeTB) TempDir() string { return tb.dir }
+
+// RunCleanup calls registered cleanup functions in reverse order.
+func (tb *FakeTB) RunCleanup() {
+	for i := len(tb.cleanups) - 1; i >= 0; i-- {
+		tb.cleanups[i]()
+	}
+}
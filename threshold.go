@@ -0,0 +1,54 @@
+package profile
+
+import (
+	"sync"
+	"time"
+)
+
+// WithCPUThreshold configures cpu profiling to run only while the process CPU
+// utilization exceeds percent, measured every interval. Utilization is relative
+// to a single CPU, so may exceed 100 on multicore machines. As with WithGate,
+// each window of profiling is written to a separate numbered file.
+//
+// Utilization is measured from /proc/self/stat on Linux. On other platforms,
+// or if utilization cannot be measured, a warning is logged and cpu profiling
+// runs continuously.
+func WithCPUThreshold(percent float64, interval time.Duration) func(*Profile) {
+	return func(p *Profile) {
+		t := &threshold{p: p, percent: percent}
+		p.Configure(WithGate(t.above, interval))
+	}
+}
+
+// threshold is a gate predicate that reports whether CPU utilization since the
+// previous call exceeds a threshold.
+type threshold struct {
+	p       *Profile
+	percent float64
+
+	once sync.Once
+	cpu  time.Duration
+	wall time.Time
+}
+
+func (t *threshold) above() bool {
+	cpu, err := cputime()
+	if err != nil {
+		t.once.Do(func() {
+			t.p.log("cpu threshold: cannot measure utilization: %v: profiling continuously", err)
+		})
+		return true
+	}
+
+	// Compute utilization since the previous measurement.
+	wall := time.Now()
+	above := false
+	if !t.wall.IsZero() {
+		elapsed := wall.Sub(t.wall)
+		utilization := 100 * float64(cpu-t.cpu) / float64(elapsed)
+		above = utilization > t.percent
+	}
+	t.cpu, t.wall = cpu, wall
+
+	return above
+}
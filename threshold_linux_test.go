@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package profile_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithCPUThreshold(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.WithCPUThreshold(50, 100*time.Millisecond),
+		profile.WithLogger(Logger(t)),
+	)
+
+	// Expect no profiling while idle.
+	time.Sleep(500 * time.Millisecond)
+	AssertDirContains(t, dir, nil)
+
+	// Expect profiling while busy.
+	spin(time.Second)
+	p.Stop()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("expected cpu profile window while busy")
+	}
+	for _, entry := range entries {
+		if ok, _ := filepath.Match("cpu-*.pprof", entry.Name()); !ok {
+			t.Errorf("unexpected file %q", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package profile
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// WithTraceSizeLimit configures the execution trace to stop automatically once
+// its output reaches maxBytes, protecting disk space on a runaway process. The
+// trace is stopped cleanly, so the output remains valid, but it may exceed the
+// limit slightly since buffered events are flushed. Ignored with WithRotation
+// and WithTraceSplit, which bound output by other means.
+func WithTraceSizeLimit(maxBytes int64) func(*Profile) {
+	return func(p *Profile) { p.tracelimit = maxBytes }
+}
+
+// limitwriter counts bytes written, calling a function once the count reaches
+// a limit. Writes are never dropped.
+type limitwriter struct {
+	w     io.Writer
+	n     int64
+	limit int64
+	once  sync.Once
+	fn    func()
+}
+
+func (l *limitwriter) Write(b []byte) (int, error) {
+	n, err := l.w.Write(b)
+	if atomic.AddInt64(&l.n, int64(n)) >= l.limit {
+		l.once.Do(l.fn)
+	}
+	return n, err
+}
+
+// limittrace wraps the execution trace output f to stop the trace once the
+// size limit is reached, if configured. The returned function must be called
+// once the tracer has recorded f as its current output. The trace is stopped
+// asynchronously, since trace.Stop waits for pending writes.
+func (p *Profile) limittrace(t *tracer, f io.WriteCloser) (io.Writer, func()) {
+	if p.tracelimit <= 0 {
+		return f, func() {}
+	}
+	ready := make(chan struct{})
+	w := &limitwriter{w: f, limit: p.tracelimit, fn: func() {
+		go func() {
+			<-ready
+			p.truncatetrace(t, f)
+		}()
+	}}
+	return w, func() { close(ready) }
+}
+
+// truncatetrace stops the execution trace writing to f, since it has reached
+// the size limit. Has no effect if the trace has since moved on from f.
+func (p *Profile) truncatetrace(t *tracer, f io.WriteCloser) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t.f != f {
+		return
+	}
+	if err := t.stop(p); err != nil {
+		p.log("trace profile: error stopping at size limit: %v", err)
+		return
+	}
+	p.log("trace profile: truncated at size limit of %d bytes", p.tracelimit)
+}
@@ -0,0 +1,112 @@
+package profile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// WithScheme configures output filenames that are URLs with the given scheme to
+// be opened with the open function. For example, a scheme "s3" could upload
+// profiles written to "s3://bucket/cpu.pprof". The "file" and "http" schemes
+// are built in: file URLs are written to the local filesystem, and http and
+// https URLs are sent to the server in a POST request once the profile is
+// complete, timing out after 30 seconds. URL outputs are not affected by output
+// directories, sequence numbers or archives.
+func WithScheme(scheme string, open func(u *url.URL) (io.WriteCloser, error)) func(*Profile) {
+	return func(p *Profile) {
+		if p.schemes == nil {
+			p.schemes = map[string]func(*url.URL) (io.WriteCloser, error){}
+		}
+		p.schemes[scheme] = open
+	}
+}
+
+// builtinschemes are the schemes supported without configuration.
+var builtinschemes = map[string]func(*url.URL) (io.WriteCloser, error){
+	"file":  openfile,
+	"http":  openhttp,
+	"https": openhttp,
+}
+
+// isurl reports whether filename is a URL.
+func isurl(filename string) bool {
+	return strings.Contains(filename, "://")
+}
+
+// openurl opens the output URL u.
+func (p *Profile) openurl(filename string) (io.WriteCloser, error) {
+	u, err := url.Parse(filename)
+	if err != nil {
+		return nil, err
+	}
+	open, ok := p.schemes[u.Scheme]
+	if !ok {
+		open, ok = builtinschemes[u.Scheme]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unsupported output scheme %q", u.Scheme)
+	}
+	return open(u)
+}
+
+// openfile opens a file URL on the local filesystem.
+func openfile(u *url.URL) (io.WriteCloser, error) {
+	return os.Create(fileurlpath(u, runtime.GOOS))
+}
+
+// fileurlpath returns the local path of the file URL u on the operating system
+// goos. On Windows, file:///C:/dir/f is the path C:\dir\f, and
+// file://host/dir/f is the UNC path \\host\dir\f.
+func fileurlpath(u *url.URL, goos string) string {
+	path := u.Path
+	if goos != "windows" {
+		return path
+	}
+	switch {
+	case u.Host != "" && u.Host != "localhost":
+		path = "//" + u.Host + path
+	case len(path) >= 3 && path[0] == '/' && path[2] == ':':
+		path = path[1:]
+	}
+	return strings.ReplaceAll(path, "/", `\`)
+}
+
+// httptimeout is the time limit for requests sending profiles to http URLs.
+const httptimeout = 30 * time.Second
+
+// openhttp opens an http URL, to which the profile is sent with a POST
+// request when closed.
+func openhttp(u *url.URL) (io.WriteCloser, error) {
+	return &httpwriter{
+		client: &http.Client{Timeout: httptimeout},
+		url:    u.String(),
+	}, nil
+}
+
+// httpwriter buffers output and sends it in a POST request on close.
+type httpwriter struct {
+	client *http.Client
+	url    string
+	buf    bytes.Buffer
+}
+
+func (w *httpwriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
+
+func (w *httpwriter) Close() error {
+	res, err := w.client.Post(w.url, "application/octet-stream", &w.buf)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("post %s: unexpected status %s", w.url, res.Status)
+	}
+	return nil
+}
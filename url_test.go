@@ -0,0 +1,92 @@
+package profile_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/mmcloughlin/profile"
+)
+
+func TestHTTPOutput(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/profiles/cpu" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	p := profile.Start(
+		profile.WithCPUProfileFile(srv.URL+"/profiles/cpu"),
+		profile.WithLogger(Logger(t)),
+	)
+	spin(10 * time.Millisecond)
+	p.Stop()
+
+	select {
+	case b := <-bodies:
+		if _, err := pprofile.Parse(bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("expected cpu profile to be posted")
+	}
+}
+
+func TestWithScheme(t *testing.T) {
+	fs := NewMemFS()
+	var opened []string
+	open := func(u *url.URL) (io.WriteCloser, error) {
+		opened = append(opened, u.String())
+		return fs.Create(u.Host + u.Path)
+	}
+
+	profile.Start(
+		profile.WithMemProfileFile("mem://bucket/mem.pprof"),
+		profile.WithScheme("mem", open),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	if len(opened) != 1 || opened[0] != "mem://bucket/mem.pprof" {
+		t.Fatalf("unexpected opened urls %v", opened)
+	}
+	if len(fs.Bytes("bucket/mem.pprof")) == 0 {
+		t.Fatal("expected profile output")
+	}
+}
+
+func TestFileURLPath(t *testing.T) {
+	cases := []struct {
+		URL    string
+		GOOS   string
+		Expect string
+	}{
+		{URL: "file:///tmp/cpu.pprof", GOOS: "linux", Expect: "/tmp/cpu.pprof"},
+		{URL: "file:///C:/profiles/cpu.pprof", GOOS: "windows", Expect: `C:\profiles\cpu.pprof`},
+		{URL: "file://localhost/C:/cpu.pprof", GOOS: "windows", Expect: `C:\cpu.pprof`},
+		{URL: "file://server/share/cpu.pprof", GOOS: "windows", Expect: `\\server\share\cpu.pprof`},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := profile.FileURLPath(u, c.GOOS); got != c.Expect {
+			t.Errorf("FileURLPath(%s, %s) = %q; expect %q", c.URL, c.GOOS, got, c.Expect)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package profile
+
+import "time"
+
+// WithWarmup configures the cpu profile and execution trace to start after a
+// delay of d, rather than immediately, so that they capture steady-state
+// behavior without the noise of program setup. Other profiles start
+// immediately. If profiling is stopped before the warmup completes, the
+// delayed profiles are not written. Failures to start the delayed profiles are
+// logged, reported to error handlers and returned by Close.
+func WithWarmup(d time.Duration) func(*Profile) {
+	return func(p *Profile) { p.warmup = d }
+}
+
+// warms reports whether method m is delayed by the warmup.
+func warms(m method) bool {
+	switch m.(type) {
+	case *cpu, *tracer:
+		return true
+	}
+	return false
+}
+
+// warmup is a pending start of methods delayed by the warmup.
+type warmup struct {
+	timer   *time.Timer
+	stopped bool
+	err     error
+}
+
+// startwarmup starts methods ms once the warmup has elapsed, in the background.
+func (p *Profile) startwarmup(ms []method) {
+	w := &warmup{}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.warming = w
+	w.timer = time.AfterFunc(p.warmup, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		// Profiling may have stopped while waiting for the lock.
+		if w.stopped {
+			return
+		}
+
+		p.info("warmup complete: starting profiles")
+		for _, m := range ms {
+			if err := p.startmethod(m); err != nil && w.err == nil {
+				w.err = err
+			}
+		}
+	})
+}
+
+// stopwarmup cancels the pending warmup, if any, and returns the first error
+// starting the delayed methods. Must be called with the lock held.
+func (p *Profile) stopwarmup() error {
+	w := p.warming
+	if w == nil {
+		return nil
+	}
+	p.warming = nil
+	w.stopped = true
+	w.timer.Stop()
+	return w.err
+}
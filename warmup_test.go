@@ -0,0 +1,115 @@
+package profile_test
+
+import (
+	"io/ioutil"
+	"log"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/profile"
+)
+
+func TestWithWarmup(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	// Log to a channel so we can wait for the warmup to complete.
+	lines := make(chan string, 16)
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.WithWarmup(100*time.Millisecond),
+		profile.WithLogger(log.New(LineWriter(lines), "", 0)),
+	)
+
+	// The cpu profile should not be running yet, so another may be started.
+	if err := pprof.StartCPUProfile(ioutil.Discard); err != nil {
+		t.Fatalf("cpu profile started before warmup: %v", err)
+	}
+	pprof.StopCPUProfile()
+
+	// Wait for the profile to start, which should only be logged once the
+	// warmup completes.
+	WaitForLine(t, lines, "cpu profile: started", "warmup complete")
+
+	if err := pprof.StartCPUProfile(ioutil.Discard); err == nil {
+		pprof.StopCPUProfile()
+		t.Fatal("expected cpu profile to be running after warmup")
+	}
+
+	spin(50 * time.Millisecond)
+	p.Stop()
+
+	AssertDirContains(t, dir, []string{"cpu.pprof"})
+}
+
+func TestWithWarmupStopEarly(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	profile.Start(
+		profile.CPUProfile,
+		profile.TraceProfile,
+		profile.WithWarmup(time.Hour),
+		profile.WithLogger(Logger(t)),
+	).Stop()
+
+	AssertDirContains(t, dir, nil)
+}
+
+func TestWithWarmupStartError(t *testing.T) {
+	dir := t.TempDir()
+	Chdir(t, dir)
+
+	var phases []string
+	lines := make(chan string, 16)
+	p := profile.Start(
+		profile.CPUProfile,
+		profile.WithWarmup(100*time.Millisecond),
+		profile.WithLogger(log.New(LineWriter(lines), "", 0)),
+		profile.WithErrorHandler(func(name, phase string, err error) {
+			phases = append(phases, name+" "+phase)
+		}),
+	)
+
+	// Occupy the cpu profiler, so the profile fails to start after warmup.
+	if err := pprof.StartCPUProfile(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	defer pprof.StopCPUProfile()
+
+	WaitForLine(t, lines, "cpu profile: error starting", "warmup complete")
+
+	// The failure should be returned, and reported to the error handler.
+	err := p.Close()
+	if err == nil || !strings.Contains(err.Error(), "cpu profile") {
+		t.Fatalf("expected cpu profile start error; got %v", err)
+	}
+	if len(phases) != 1 || phases[0] != "cpu start" {
+		t.Fatalf("error handler phases %v; expect [cpu start]", phases)
+	}
+}
+
+// WaitForLine waits for a line containing substr to be received from lines,
+// failing unless a line containing after was received first.
+func WaitForLine(t *testing.T, lines <-chan string, substr, after string) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	seen := false
+	for {
+		select {
+		case line := <-lines:
+			t.Log(line)
+			if strings.Contains(line, substr) {
+				if !seen {
+					t.Fatalf("%q logged before %q", substr, after)
+				}
+				return
+			}
+			seen = seen || strings.Contains(line, after)
+		case <-timeout:
+			t.Fatalf("timeout waiting for %q", substr)
+		}
+	}
+}